@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"strconv"
+)
+
+const (
+	FieldManagerLogtubeAutoMapping = "auto-logtube-mapping"
+)
+
+var (
+	optServerSide, _ = strconv.ParseBool(os.Getenv("AUTO_LOGTUBE_MAPPING_SERVER_SIDE"))
+)
+
+// applyManagers returns field managers with server-side apply operations
+func applyManagers(fields []metav1.ManagedFieldsEntry) (managers []string) {
+	for _, f := range fields {
+		if f.Operation == metav1.ManagedFieldsOperationApply {
+			managers = append(managers, f.Manager)
+		}
+	}
+	return
+}
+
+// serverSide checks whether to map the workload with server-side apply, only for built-in kinds,
+// lists in custom resources without list-map keys are atomic, and always conflict with other managers
+func (wl *Workload) serverSide() bool {
+	return optServerSide && !wl.JSONPatch
+}
+
+// appliedBy checks whether the field manager has applied to the workload
+func (wl *Workload) appliedBy(manager string) bool {
+	for _, m := range wl.ApplyManagers {
+		if m == manager {
+			return true
+		}
+	}
+	return false
+}
+
+// buildApplyPatch builds a server-side apply configuration, containing only the volumes and volume mounts
+// owned by the auto mapping, other fields are left to their own managers
+func (wl *Workload) buildApplyPatch(wp *WorkloadPatch) (data []byte, err error) {
+	if wl.APIVersion == "" || wl.ObjectKind == "" {
+		err = errors.New("unknown object type, server-side apply is not supported")
+		return
+	}
+	type containerApply struct {
+		Name         string               `json:"name"`
+		VolumeMounts []corev1.VolumeMount `json:"volumeMounts"`
+	}
+	var containers []containerApply
+	for _, c := range wp.Spec.Template.Spec.Containers {
+		containers = append(containers, containerApply{Name: c.Name, VolumeMounts: c.VolumeMounts})
+	}
+	podSpec := map[string]interface{}{
+		"volumes":    wp.Spec.Template.Spec.Volumes,
+		"containers": containers,
+	}
+	obj := nestAt(wl.templatePath(), map[string]interface{}{"spec": podSpec}).(map[string]interface{})
+	obj["apiVersion"] = wl.APIVersion
+	obj["kind"] = wl.ObjectKind
+	obj["metadata"] = map[string]interface{}{"name": wl.Name, "namespace": wl.Namespace}
+	data, err = json.Marshal(obj)
+	return
+}
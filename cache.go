@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	optCacheConfigMap     = os.Getenv("AUTO_LOGTUBE_MAPPING_CACHE_CONFIGMAP")
+	optCacheMaxEntries, _ = strconv.Atoi(os.Getenv("AUTO_LOGTUBE_MAPPING_CACHE_MAX_ENTRIES"))
+)
+
+// CacheEntry is the cached discovery result of a container image
+type CacheEntry struct {
+	LogPaths []string `json:"paths"`
+	Source   string   `json:"source"`
+}
+
+// DiscoveryCache caches log paths discovered from running pods, keyed by image digest and container name
+type DiscoveryCache interface {
+	Get(key string) (entry CacheEntry, ok bool)
+	Set(key string, entry CacheEntry)
+	// Save persists modified entries
+	Save(ctx context.Context) error
+}
+
+// containerImageDigest returns the image digest of a running container from pod status, empty if unknown
+func containerImageDigest(pod *corev1.Pod, containerName string) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != containerName {
+			continue
+		}
+		imageID := cs.ImageID
+		if i := strings.LastIndex(imageID, "@"); i >= 0 {
+			return imageID[i+1:]
+		}
+		// docker://sha256:..., image id is the digest of image config
+		if i := strings.Index(imageID, "://"); i >= 0 {
+			imageID = imageID[i+3:]
+		}
+		if strings.HasPrefix(imageID, "sha256:") {
+			return imageID
+		}
+	}
+	return ""
+}
+
+// buildCacheKey builds a valid ConfigMap key from image digest and container name
+func buildCacheKey(digest, containerName string) string {
+	return strings.Replace(digest, ":", "-", -1) + "." + containerName
+}
+
+// configMapCache stores entries in a single ConfigMap, loaded once and saved at end of run
+type configMapCache struct {
+	client    *kubernetes.Clientset
+	namespace string
+	name      string
+
+	mu      sync.Mutex
+	entries map[string]CacheEntry
+	dirty   map[string]bool
+	// used keys looked up or set since started, never pruned
+	used map[string]bool
+	// detached failed to load the ConfigMap, entries are kept in memory only
+	detached bool
+}
+
+// newConfigMapCache loads cache from ConfigMap, ref is in form of [NAMESPACE/]NAME,
+// defaults to namespace of service account, the cache is best effort, failures are logged only
+func newConfigMapCache(ctx context.Context, client *kubernetes.Clientset, ref string) (c *configMapCache) {
+	c = &configMapCache{
+		client:    client,
+		namespace: currentNamespace(),
+		name:      ref,
+		entries:   map[string]CacheEntry{},
+		dirty:     map[string]bool{},
+		used:      map[string]bool{},
+	}
+	if i := strings.Index(ref, "/"); i >= 0 {
+		c.namespace, c.name = ref[:i], ref[i+1:]
+	}
+	cm, err := client.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("failed to load discovery cache %s/%s, continue without persisting: %s", c.namespace, c.name, err.Error())
+			c.detached = true
+		}
+		return
+	}
+	c.load(cm)
+	return
+}
+
+func (c *configMapCache) load(cm *corev1.ConfigMap) {
+	for key, value := range cm.Data {
+		var entry CacheEntry
+		// ignore malformed entries, they are re-probed and overwritten
+		if err := json.Unmarshal([]byte(value), &entry); err != nil || len(entry.LogPaths) == 0 {
+			continue
+		}
+		c.entries[key] = entry
+	}
+}
+
+func (c *configMapCache) Get(key string) (entry CacheEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok = c.entries[key]; ok {
+		c.used[key] = true
+	}
+	return
+}
+
+func (c *configMapCache) Set(key string, entry CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry
+	c.dirty[key] = true
+	c.used[key] = true
+}
+
+// Save writes modified entries into ConfigMap, entries written by others in the meantime are kept,
+// unused entries are pruned once the ConfigMap exceeds max entries
+func (c *configMapCache) Save(ctx context.Context) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.detached || len(c.dirty) == 0 {
+		return
+	}
+
+	data := map[string]string{}
+	for key := range c.dirty {
+		var buf []byte
+		if buf, err = json.Marshal(c.entries[key]); err != nil {
+			return
+		}
+		data[key] = string(buf)
+	}
+
+	// retry once on conflict
+	for retry := 0; ; retry++ {
+		var cm *corev1.ConfigMap
+		if cm, err = c.client.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.name, metav1.GetOptions{}); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return
+			}
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: c.namespace, Name: c.name}, Data: data}
+			_, err = c.client.CoreV1().ConfigMaps(c.namespace).Create(ctx, cm, metav1.CreateOptions{})
+		} else {
+			if cm.Data == nil {
+				cm.Data = map[string]string{}
+			}
+			for key, value := range data {
+				cm.Data[key] = value
+			}
+			cm.Data = pruneCacheData(cm.Data, c.used, optCacheMaxEntries)
+			_, err = c.client.CoreV1().ConfigMaps(c.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		}
+		if err != nil && retry == 0 && (apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)) {
+			continue
+		}
+		break
+	}
+	if err == nil {
+		c.dirty = map[string]bool{}
+	}
+	return
+}
+
+// pruneCacheData drops entries not in used until no more than max entries left, 0 means defaults to 1000,
+// entries in used are always kept, images of them are still running
+func pruneCacheData(data map[string]string, used map[string]bool, max int) map[string]string {
+	if max <= 0 {
+		max = 1000
+	}
+	if len(data) <= max {
+		return data
+	}
+	var keys []string
+	for key := range data {
+		if !used[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(data) <= max {
+			break
+		}
+		delete(data, key)
+	}
+	return data
+}
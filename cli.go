@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	BinaryName = "auto-logtube-mapping"
+)
+
+// Command is a subcommand of auto-logtube-mapping
+type Command struct {
+	Name        string
+	Description string
+
+	setup func(fs *flag.FlagSet)
+	run   func(ctx context.Context) error
+}
+
+var commands = []*Command{
+	{
+		Name:        "plan",
+		Description: "compute patches for enabled workloads, change nothing",
+		setup: func(fs *flag.FlagSet) {
+			optDryRun = true
+			addClusterFlags(fs)
+			addScanFlags(fs)
+		},
+		run: func(ctx context.Context) error {
+			return runClusterCommand(ctx, true, runOnce)
+		},
+	},
+	{
+		Name:        "validate",
+		Description: "send patches for enabled workloads with server-side dry run, report rejected ones, persist nothing",
+		setup: func(fs *flag.FlagSet) {
+			optValidate = true
+			addClusterFlags(fs)
+			addScanFlags(fs)
+		},
+		run: func(ctx context.Context) error {
+			return runClusterCommand(ctx, true, runOnce)
+		},
+	},
+	{
+		Name:        "apply",
+		Description: "map log directories of enabled workloads to host",
+		setup: func(fs *flag.FlagSet) {
+			addClusterFlags(fs)
+			addScanFlags(fs)
+			addLeaderElectFlags(fs)
+		},
+		run: func(ctx context.Context) error {
+			return runClusterCommand(ctx, true, runOnce)
+		},
+	},
+	{
+		Name:        "unmap",
+		Description: "remove auto mapping volume and volume mounts from a workload, or all workloads in scope",
+		setup: func(fs *flag.FlagSet) {
+			addClusterFlags(fs)
+			addScopeFlags(fs)
+			addDryRunFlag(fs, "AUTO_LOGTUBE_MAPPING_DRY_RUN")
+			fs.BoolVar(&optAllNamespaces, "all-namespaces", optAllNamespaces, "unmap workloads in all namespaces, required if --namespace is not set, env AUTO_LOGTUBE_MAPPING_ALL_NAMESPACES")
+			fs.StringVar(&optUnmapWorkload, "workload", optUnmapWorkload, "only unmap this workload, in form of KIND/NAME, e.g. deployment/demo, requires --namespace, env AUTO_LOGTUBE_MAPPING_UNMAP_WORKLOAD")
+		},
+		run: func(ctx context.Context) error {
+			return runClusterCommand(ctx, false, runUnmap)
+		},
+	},
+	{
+		Name:        "status",
+		Description: "show current mappings of workloads",
+		setup: func(fs *flag.FlagSet) {
+			addClusterFlags(fs)
+			addScopeFlags(fs)
+		},
+		run: func(ctx context.Context) error {
+			return runClusterCommand(ctx, false, runStatus)
+		},
+	},
+	{
+		Name:        "migrate",
+		Description: "migrate legacy filebeat-collect-logs volumes to LOGTUBE_K8S_AUTO_MAPPING",
+		setup: func(fs *flag.FlagSet) {
+			addClusterFlags(fs)
+			addScopeFlags(fs)
+			addDryRunFlag(fs, "MIGRATE_LOGTUBE_MAPPING_DRY_RUN")
+		},
+		run: func(ctx context.Context) error {
+			return runClusterCommand(ctx, false, runMigrate)
+		},
+	},
+	{
+		Name:        "controller",
+		Description: "watch workloads and pods, map enabled workloads continuously",
+		setup: func(fs *flag.FlagSet) {
+			addClusterFlags(fs)
+			addHostPathFlags(fs)
+			addDiscoveryFlags(fs)
+			addCustomResourcesFlag(fs)
+			addLeaderElectFlags(fs)
+			addDryRunFlag(fs, "AUTO_LOGTUBE_MAPPING_DRY_RUN")
+			addWorkersFlag(fs)
+			addCacheFlag(fs)
+			addServerSideFlag(fs)
+			fs.DurationVar(&optControllerResync, "resync", optControllerResync, "resync period of informers, env AUTO_LOGTUBE_MAPPING_RESYNC")
+		},
+		run: func(ctx context.Context) error {
+			return runClusterCommand(ctx, true, runController)
+		},
+	},
+	{
+		Name:        "webhook",
+		Description: "serve mutating admission webhook, inject log volume at creation",
+		setup: func(fs *flag.FlagSet) {
+			addHostPathFlags(fs)
+			addDiscoveryFlags(fs)
+			fs.StringVar(&optWebhookAddr, "addr", optWebhookAddr, "listen address, env AUTO_LOGTUBE_MAPPING_WEBHOOK_ADDR")
+			fs.StringVar(&optWebhookTLSCert, "tls-cert", optWebhookTLSCert, "TLS certificate file, env AUTO_LOGTUBE_MAPPING_WEBHOOK_TLS_CERT")
+			fs.StringVar(&optWebhookTLSKey, "tls-key", optWebhookTLSKey, "TLS private key file, env AUTO_LOGTUBE_MAPPING_WEBHOOK_TLS_KEY")
+		},
+		run: func(ctx context.Context) (err error) {
+			if err = requireHostPath(); err != nil {
+				return
+			}
+			err = runWebhook(ctx)
+			return
+		},
+	},
+}
+
+func (cmd *Command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(BinaryName+" "+cmd.Name, flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		_, _ = fmt.Fprintf(out, "Usage: %s %s [flags]\n\n%s\n\nFlags:\n", BinaryName, cmd.Name, cmd.Description)
+		fs.PrintDefaults()
+	}
+	cmd.setup(fs)
+	return fs
+}
+
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// resolveCommand resolves subcommand from arguments, returns nil if help is requested
+//
+// for compatibility with existing manifests, the legacy binary name 'migrate-logtube-mapping' runs 'migrate',
+// and if no subcommand is given, it's decided by AUTO_LOGTUBE_MAPPING_MODE and AUTO_LOGTUBE_MAPPING_DRY_RUN
+func resolveCommand(args []string) (cmd *Command, rest []string) {
+	if filepath.Base(args[0]) == "migrate-logtube-mapping" {
+		return findCommand("migrate"), args[1:]
+	}
+	if len(args) > 1 {
+		switch args[1] {
+		case "help", "-h", "-help", "--help":
+			return
+		}
+		if !strings.HasPrefix(args[1], "-") {
+			if cmd = findCommand(args[1]); cmd == nil {
+				_, _ = fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", args[1])
+				printUsage(os.Stderr)
+				os.Exit(2)
+			}
+			rest = args[2:]
+			return
+		}
+	}
+	rest = args[1:]
+	switch optMode {
+	case ModeController:
+		cmd = findCommand("controller")
+	case ModeWebhook:
+		cmd = findCommand("webhook")
+	default:
+		if optDryRun {
+			cmd = findCommand("plan")
+		} else {
+			cmd = findCommand("apply")
+		}
+	}
+	return
+}
+
+func printUsage(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", BinaryName)
+	for _, cmd := range commands {
+		_, _ = fmt.Fprintf(out, "  %-12s%s\n", cmd.Name, cmd.Description)
+	}
+	_, _ = fmt.Fprintf(out, "\nRun '%s <command> --help' for flags of a command.\n", BinaryName)
+}
+
+func addClusterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&optKubeconfig, "kubeconfig", optKubeconfig, "path to the kubeconfig file, in-cluster config is used if neither --kubeconfig, --context nor $KUBECONFIG is set")
+	fs.StringVar(&optContext, "context", optContext, "name of the kubeconfig context to use")
+}
+
+func addScopeFlags(fs *flag.FlagSet) {
+	fs.StringVar(&optNamespace, "namespace", optNamespace, "only process workloads in this namespace, env AUTO_LOGTUBE_MAPPING_NAMESPACE")
+	addCustomResourcesFlag(fs)
+}
+
+func addCustomResourcesFlag(fs *flag.FlagSet) {
+	fs.StringVar(&optCustomResources, "custom-resources", optCustomResources, "custom workload resources, env AUTO_LOGTUBE_MAPPING_CUSTOM_RESOURCES")
+}
+
+func addHostPathFlags(fs *flag.FlagSet) {
+	fs.StringVar(&optHostPath, "host-path", optHostPath, "host directory for logs, env "+EnvLogtubeLogsHostPath)
+}
+
+func addScanFlags(fs *flag.FlagSet) {
+	addScopeFlags(fs)
+	addHostPathFlags(fs)
+	addDiscoveryFlags(fs)
+	addWorkersFlag(fs)
+	addCacheFlag(fs)
+	addOutputFlag(fs)
+	addServerSideFlag(fs)
+	fs.IntVar(&optMaxFailures, "max-failures", optMaxFailures, "max number of failed workloads and list calls tolerated before exiting non-zero, default 0, env AUTO_LOGTUBE_MAPPING_MAX_FAILURES")
+}
+
+func addWorkersFlag(fs *flag.FlagSet) {
+	fs.IntVar(&optWorkers, "workers", optWorkers, "number of workloads processed concurrently, default 2, env AUTO_LOGTUBE_MAPPING_WORKERS")
+}
+
+func addServerSideFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&optServerSide, "server-side", optServerSide, "map built-in workloads with server-side apply under field manager '"+FieldManagerLogtubeAutoMapping+"', custom workloads keep using JSON patch, conflicts with other managers are reported instead of overwritten, env AUTO_LOGTUBE_MAPPING_SERVER_SIDE")
+}
+
+func addOutputFlag(fs *flag.FlagSet) {
+	fs.StringVar(&optOutput, "output", optOutput, "output format, 'text' or 'json', with 'json' logs are written to stderr and the report is printed to stdout as a JSON document, env AUTO_LOGTUBE_MAPPING_OUTPUT")
+}
+
+func addCacheFlag(fs *flag.FlagSet) {
+	fs.StringVar(&optCacheConfigMap, "cache-configmap", optCacheConfigMap, "ConfigMap caching discovered log paths by image digest, in form of [NAMESPACE/]NAME, namespace defaults to the service account's, disabled if empty, env AUTO_LOGTUBE_MAPPING_CACHE_CONFIGMAP")
+	fs.IntVar(&optCacheMaxEntries, "cache-max-entries", optCacheMaxEntries, "max number of entries in cache ConfigMap, entries unused in this run are pruned beyond it, default 1000, env AUTO_LOGTUBE_MAPPING_CACHE_MAX_ENTRIES")
+}
+
+// linesValue is a repeatable flag appending values to a newline separated option
+type linesValue struct {
+	p *string
+}
+
+func (v linesValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v linesValue) Set(s string) error {
+	if *v.p != "" {
+		*v.p += "\n"
+	}
+	*v.p += s
+	return nil
+}
+
+func addDiscoveryFlags(fs *flag.FlagSet) {
+	fs.StringVar(&optDiscoverers, "discoverers", optDiscoverers, "ordered log path discoverers, separated by ',', default 'spec-env,annotation,exec-env,exec-marker' followed by custom scripts, env AUTO_LOGTUBE_MAPPING_DISCOVERERS")
+	fs.Var(linesValue{p: &optDiscoveryScripts}, "discovery-script", "custom discovery script in form of NAME=SCRIPT, referenced as 'script:NAME' in --discoverers, can be repeated, env AUTO_LOGTUBE_MAPPING_DISCOVERY_SCRIPTS, one per line")
+	fs.DurationVar(&optExecTimeout, "exec-timeout", optExecTimeout, "timeout of a single exec into container, default 30s, env AUTO_LOGTUBE_MAPPING_EXEC_TIMEOUT")
+	fs.IntVar(&optExecPerNode, "exec-per-node", optExecPerNode, "max concurrent execs into pods on the same node, default 2, env AUTO_LOGTUBE_MAPPING_EXEC_PER_NODE")
+	fs.IntVar(&optProbeWorkers, "probe-workers", optProbeWorkers, "max number of pods probed concurrently across all workloads, default 8, env AUTO_LOGTUBE_MAPPING_PROBE_WORKERS")
+	fs.StringVar(&optProbePods, "probe-pods", optProbePods, "number of pods to probe, or 'all', all pods must report the same log paths, default 1, env AUTO_LOGTUBE_MAPPING_PROBE_PODS")
+	fs.StringVar(&optRegistryInsecure, "registry-insecure", optRegistryInsecure, "registries accessed with plain HTTP, separated by ',', env AUTO_LOGTUBE_MAPPING_REGISTRY_INSECURE")
+	fs.StringVar(&optRegistryPlatform, "registry-platform", optRegistryPlatform, "platform to pick from image index, default 'linux/amd64', env AUTO_LOGTUBE_MAPPING_REGISTRY_PLATFORM")
+}
+
+func addLeaderElectFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&optLeaderElect, "leader-elect", optLeaderElect, "enable leader election, env AUTO_LOGTUBE_MAPPING_LEADER_ELECT")
+	fs.StringVar(&optLeaderElectLease, "leader-elect-lease", optLeaderElectLease, "name of the lease, env AUTO_LOGTUBE_MAPPING_LEADER_ELECT_LEASE")
+	fs.StringVar(&optLeaderElectLeaseNS, "leader-elect-namespace", optLeaderElectLeaseNS, "namespace of the lease, env AUTO_LOGTUBE_MAPPING_LEADER_ELECT_NAMESPACE")
+}
+
+func addDryRunFlag(fs *flag.FlagSet, env string) {
+	optDryRun, _ = strconv.ParseBool(os.Getenv(env))
+	fs.BoolVar(&optDryRun, "dry-run", optDryRun, "print what would be done, change nothing, env "+env)
+}
+
+func requireHostPath() error {
+	if optHostPath == "" {
+		return errors.New("missing --host-path or environment variable: " + EnvLogtubeLogsHostPath)
+	}
+	return nil
+}
+
+// runClusterCommand connects to the cluster and invokes fn, with leader election if enabled
+func runClusterCommand(ctx context.Context, hostPathRequired bool, fn func(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset) error) (err error) {
+	if hostPathRequired {
+		if err = requireHostPath(); err != nil {
+			return
+		}
+	}
+
+	var cfg *rest.Config
+	if cfg, err = buildRESTConfig(optKubeconfig, optContext); err != nil {
+		return
+	}
+	var client *kubernetes.Clientset
+	if client, err = kubernetes.NewForConfig(cfg); err != nil {
+		return
+	}
+
+	run := func(ctx context.Context) error {
+		return fn(ctx, cfg, client)
+	}
+
+	if optLeaderElect {
+		err = runWithLeaderElection(ctx, client, run)
+	} else {
+		err = run(ctx)
+	}
+	return
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
+)
+
+// buildRESTConfig loads kubeconfig with --kubeconfig, --context or $KUBECONFIG,
+// falls back to in-cluster config if none of them is set
+func buildRESTConfig(kubeconfig string, context string) (cfg *rest.Config, err error) {
+	if kubeconfig == "" && context == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		if cfg, err = rest.InClusterConfig(); err != rest.ErrNotInCluster {
+			return
+		}
+		// not running in cluster, try ~/.kube/config
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	cfg, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	return
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1beta1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	optControllerResync, _ = time.ParseDuration(os.Getenv("AUTO_LOGTUBE_MAPPING_RESYNC"))
+)
+
+// Controller watches workloads and pods, and maps workloads as soon as they are enabled and have a ready pod
+type Controller struct {
+	client *kubernetes.Clientset
+	mapper *Mapper
+
+	dynClient dynamic.Interface
+
+	factory  informers.SharedInformerFactory
+	dpLister appslisters.DeploymentLister
+	stLister appslisters.StatefulSetLister
+	dsLister appslisters.DaemonSetLister
+	cjLister batchlisters.CronJobLister
+	synced   []cache.InformerSynced
+
+	dynFactory    dynamicinformer.DynamicSharedInformerFactory
+	crs           map[string]CustomResource
+	customListers map[string]cache.GenericLister
+
+	queue workqueue.RateLimitingInterface
+}
+
+func newController(mapper *Mapper, client *kubernetes.Clientset, dynClient dynamic.Interface, crs []CustomResource, resync time.Duration) *Controller {
+	c := &Controller{
+		client:        client,
+		mapper:        mapper,
+		dynClient:     dynClient,
+		factory:       informers.NewSharedInformerFactory(client, resync),
+		dynFactory:    dynamicinformer.NewDynamicSharedInformerFactory(dynClient, resync),
+		crs:           map[string]CustomResource{},
+		customListers: map[string]cache.GenericLister{},
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "auto-logtube-mapping"),
+	}
+
+	dpInformer := c.factory.Apps().V1().Deployments()
+	dpInformer.Informer().AddEventHandler(c.buildWorkloadHandler(KindDeployment))
+	c.dpLister = dpInformer.Lister()
+
+	stInformer := c.factory.Apps().V1().StatefulSets()
+	stInformer.Informer().AddEventHandler(c.buildWorkloadHandler(KindStatefulSet))
+	c.stLister = stInformer.Lister()
+
+	dsInformer := c.factory.Apps().V1().DaemonSets()
+	dsInformer.Informer().AddEventHandler(c.buildWorkloadHandler(KindDaemonSet))
+	c.dsLister = dsInformer.Lister()
+
+	cjInformer := c.factory.Batch().V1beta1().CronJobs()
+	cjInformer.Informer().AddEventHandler(c.buildWorkloadHandler(KindCronJob))
+	c.cjLister = cjInformer.Lister()
+
+	podInformer := c.factory.Core().V1().Pods()
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.handlePod(nil, pod)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, ok1 := oldObj.(*corev1.Pod)
+			newPod, ok2 := newObj.(*corev1.Pod)
+			if ok1 && ok2 {
+				c.handlePod(oldPod, newPod)
+			}
+		},
+	})
+
+	c.synced = []cache.InformerSynced{
+		dpInformer.Informer().HasSynced,
+		stInformer.Informer().HasSynced,
+		dsInformer.Informer().HasSynced,
+		cjInformer.Informer().HasSynced,
+		podInformer.Informer().HasSynced,
+	}
+
+	for _, cr := range crs {
+		crInformer := c.dynFactory.ForResource(cr.GVR)
+		crInformer.Informer().AddEventHandler(c.buildWorkloadHandler(cr.Kind()))
+		c.crs[cr.Kind()] = cr
+		c.customListers[cr.Kind()] = crInformer.Lister()
+		c.synced = append(c.synced, crInformer.Informer().HasSynced)
+	}
+	return c
+}
+
+func buildWorkloadKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+func splitWorkloadKey(key string) (kind, namespace, name string, err error) {
+	splits := strings.Split(key, "/")
+	if len(splits) != 3 {
+		err = fmt.Errorf("invalid workload key: %s", key)
+		return
+	}
+	kind, namespace, name = splits[0], splits[1], splits[2]
+	return
+}
+
+func (c *Controller) buildWorkloadHandler(kind string) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		wl, ok := obj.(metav1.Object)
+		if !ok {
+			return
+		}
+		// workloads opted out are enqueued as well, to remove the mapping
+		if !isEnabled(wl.GetAnnotations()) && !c.mappedObject(kind, obj) {
+			return
+		}
+		c.queue.Add(buildWorkloadKey(kind, wl.GetNamespace(), wl.GetName()))
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(_, newObj interface{}) {
+			enqueue(newObj)
+		},
+	}
+}
+
+// mappedObject checks whether the pod template of a workload object carries auto mapping volumes
+func (c *Controller) mappedObject(kind string, obj interface{}) bool {
+	var volumes []corev1.Volume
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		volumes = o.Spec.Template.Spec.Volumes
+	case *appsv1.StatefulSet:
+		volumes = o.Spec.Template.Spec.Volumes
+	case *appsv1.DaemonSet:
+		volumes = o.Spec.Template.Spec.Volumes
+	case *batchv1beta1.CronJob:
+		volumes = o.Spec.JobTemplate.Spec.Template.Spec.Volumes
+	case *unstructured.Unstructured:
+		cr, ok := c.crs[kind]
+		if !ok {
+			return false
+		}
+		items, _, _ := unstructured.NestedSlice(o.Object, append(append([]string{}, cr.TemplatePath...), "spec", "volumes")...)
+		for _, item := range items {
+			if v, ok := item.(map[string]interface{}); ok {
+				if name, _ := v["name"].(string); isAutoMappingVolume(name) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, v := range volumes {
+		if isAutoMappingVolume(v.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podOwner resolves kind and name of the workload controlling a pod
+func podOwner(pod *corev1.Pod) (kind string, name string) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return
+	}
+	switch ref.Kind {
+	case "ReplicaSet":
+		// replicaset created by deployment is named as [DEPLOYMENT]-[POD-TEMPLATE-HASH]
+		hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+		if hash == "" || !strings.HasSuffix(ref.Name, "-"+hash) {
+			return
+		}
+		kind, name = KindDeployment, strings.TrimSuffix(ref.Name, "-"+hash)
+	case "StatefulSet":
+		kind, name = KindStatefulSet, ref.Name
+	case "DaemonSet":
+		kind, name = KindDaemonSet, ref.Name
+	case "Job":
+		if name = cronJobName(ref.Name); name != "" {
+			kind = KindCronJob
+		}
+	}
+	return
+}
+
+// podOwnerKey resolves the workload key of the controller owning a pod
+func podOwnerKey(pod *corev1.Pod) string {
+	kind, name := podOwner(pod)
+	if kind == "" {
+		return ""
+	}
+	return buildWorkloadKey(kind, pod.Namespace, name)
+}
+
+func (c *Controller) handlePod(oldPod, newPod *corev1.Pod) {
+	// only interested in pods becoming ready
+	if !isPodReady(newPod) {
+		return
+	}
+	if oldPod != nil && isPodReady(oldPod) {
+		return
+	}
+	if key := podOwnerKey(newPod); key != "" {
+		c.queue.Add(key)
+	}
+}
+
+func (c *Controller) getWorkload(kind, namespace, name string) (wl *Workload, err error) {
+	switch kind {
+	case KindDeployment:
+		var dp *appsv1.Deployment
+		if dp, err = c.dpLister.Deployments(namespace).Get(name); err != nil {
+			return
+		}
+		wl = newDeploymentWorkload(c.client, dp.DeepCopy())
+	case KindStatefulSet:
+		var st *appsv1.StatefulSet
+		if st, err = c.stLister.StatefulSets(namespace).Get(name); err != nil {
+			return
+		}
+		wl = newStatefulSetWorkload(c.client, st.DeepCopy())
+	case KindDaemonSet:
+		var ds *appsv1.DaemonSet
+		if ds, err = c.dsLister.DaemonSets(namespace).Get(name); err != nil {
+			return
+		}
+		wl = newDaemonSetWorkload(c.client, ds.DeepCopy())
+	case KindCronJob:
+		var cj *batchv1beta1.CronJob
+		if cj, err = c.cjLister.CronJobs(namespace).Get(name); err != nil {
+			return
+		}
+		wl = newCronJobWorkload(c.client, cj.DeepCopy())
+	default:
+		cr, ok := c.crs[kind]
+		if !ok {
+			err = errors.New("unsupported workload kind: " + kind)
+			return
+		}
+		var obj runtime.Object
+		if obj, err = c.customListers[kind].ByNamespace(namespace).Get(name); err != nil {
+			return
+		}
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			err = errors.New("unexpected object type for kind: " + kind)
+			return
+		}
+		wl, err = newCustomWorkload(c.dynClient, cr, u.DeepCopy())
+	}
+	return
+}
+
+func (c *Controller) reconcile(ctx context.Context, key string) (err error) {
+	var kind, namespace, name string
+	if kind, namespace, name, err = splitWorkloadKey(key); err != nil {
+		return
+	}
+	var wl *Workload
+	if wl, err = c.getWorkload(kind, namespace, name); err != nil {
+		if apierrors.IsNotFound(err) {
+			err = nil
+		}
+		return
+	}
+	// workloads already mapped are compared and reported as already mapped, no patch is sent, so no update event loops
+	err = c.mapper.processWorkload(ctx, wl)
+	c.mapper.saveCache(ctx)
+	return
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	if err := c.reconcile(ctx, key); err != nil {
+		log.Printf("failed to reconcile [%s]: %s", key, err.Error())
+		c.queue.AddRateLimited(item)
+		return true
+	}
+	c.queue.Forget(item)
+	return true
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+// Run starts informers and workers, blocks until context is done
+func (c *Controller) Run(ctx context.Context, workers int) (err error) {
+	defer c.queue.ShutDown()
+
+	c.factory.Start(ctx.Done())
+	c.dynFactory.Start(ctx.Done())
+
+	log.Println("waiting for caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		err = errors.New("failed to wait for caches to sync")
+		return
+	}
+
+	log.Printf("starting %d workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	}
+
+	<-ctx.Done()
+	return
+}
+
+// runController runs the watch-based controller mode
+func runController(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset) (err error) {
+	workers := numWorkers()
+	resync := optControllerResync
+	if resync <= 0 {
+		resync = time.Hour
+	}
+	var crs []CustomResource
+	if crs, err = parseCustomResources(optCustomResources); err != nil {
+		return
+	}
+	var dynClient dynamic.Interface
+	if dynClient, err = dynamic.NewForConfig(cfg); err != nil {
+		return
+	}
+	var mapper *Mapper
+	if mapper, err = newMapper(ctx, cfg, client); err != nil {
+		return
+	}
+	err = newController(mapper, client, dynClient, crs, resync).Run(ctx, workers)
+	return
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	"os"
+	"strings"
+)
+
+var (
+	optCustomResources = os.Getenv("AUTO_LOGTUBE_MAPPING_CUSTOM_RESOURCES")
+)
+
+// CustomResource describes a custom workload resource embedding a pod template
+type CustomResource struct {
+	GVR          schema.GroupVersionResource
+	TemplatePath []string
+	SelectorPath []string
+	ReplicasPath []string
+}
+
+// Kind returns the workload kind of the custom resource, in form of [RESOURCE].[GROUP]
+func (cr CustomResource) Kind() string {
+	return cr.GVR.GroupResource().String()
+}
+
+// parseCustomResources parses custom resources, entries are separated by ',' or ';', in form of
+//
+//	[GROUP]/[VERSION]/[RESOURCE]:[TEMPLATE PATH]:[SELECTOR PATH][:REPLICAS PATH]
+//
+// for example
+//
+//	argoproj.io/v1alpha1/rollouts:spec.template:spec.selector
+//	apps.openshift.io/v1/deploymentconfigs:spec.template:spec.selector:status.replicas
+func parseCustomResources(s string) (crs []CustomResource, err error) {
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\n'
+	}) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		splits := strings.Split(entry, ":")
+		if len(splits) != 3 && len(splits) != 4 {
+			err = fmt.Errorf("invalid custom resource: %s", entry)
+			return
+		}
+		gvr := strings.Split(splits[0], "/")
+		var cr CustomResource
+		switch len(gvr) {
+		case 2:
+			cr.GVR = schema.GroupVersionResource{Version: gvr[0], Resource: gvr[1]}
+		case 3:
+			cr.GVR = schema.GroupVersionResource{Group: gvr[0], Version: gvr[1], Resource: gvr[2]}
+		default:
+			err = fmt.Errorf("invalid custom resource: %s", entry)
+			return
+		}
+		cr.TemplatePath = strings.Split(splits[1], ".")
+		cr.SelectorPath = strings.Split(splits[2], ".")
+		if len(splits) == 4 {
+			cr.ReplicasPath = strings.Split(splits[3], ".")
+		} else {
+			cr.ReplicasPath = []string{"status", "replicas"}
+		}
+		crs = append(crs, cr)
+	}
+	return
+}
+
+// convertSelector converts either a metav1.LabelSelector or a plain label map
+func convertSelector(obj map[string]interface{}) (selector *metav1.LabelSelector, err error) {
+	selector = &metav1.LabelSelector{}
+	_, hasMatchLabels := obj["matchLabels"]
+	_, hasMatchExpressions := obj["matchExpressions"]
+	if hasMatchLabels || hasMatchExpressions {
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj, selector)
+		return
+	}
+	selector.MatchLabels = map[string]string{}
+	for k, v := range obj {
+		vs, ok := v.(string)
+		if !ok {
+			err = fmt.Errorf("invalid selector value for key %s", k)
+			return
+		}
+		selector.MatchLabels[k] = vs
+	}
+	return
+}
+
+func newCustomWorkload(client dynamic.Interface, cr CustomResource, obj *unstructured.Unstructured) (wl *Workload, err error) {
+	wl = &Workload{
+		Kind:            cr.Kind(),
+		Namespace:       obj.GetNamespace(),
+		Name:            obj.GetName(),
+		UID:             obj.GetUID(),
+		Annotations:     obj.GetAnnotations(),
+		Template:        &corev1.PodTemplateSpec{},
+		TemplatePath:    cr.TemplatePath,
+		JSONPatch:       true,
+		ResourceVersion: obj.GetResourceVersion(),
+		APIVersion:      obj.GetAPIVersion(),
+		ObjectKind:      obj.GetKind(),
+		ApplyManagers:   applyManagers(obj.GetManagedFields()),
+	}
+
+	var (
+		m     map[string]interface{}
+		found bool
+	)
+	if m, found, err = unstructured.NestedMap(obj.Object, cr.TemplatePath...); err != nil {
+		return
+	} else if !found {
+		err = fmt.Errorf("missing pod template at %s", strings.Join(cr.TemplatePath, "."))
+		return
+	}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(m, wl.Template); err != nil {
+		return
+	}
+
+	if m, found, err = unstructured.NestedMap(obj.Object, cr.SelectorPath...); err != nil {
+		return
+	} else if found {
+		if wl.Selector, err = convertSelector(m); err != nil {
+			return
+		}
+	}
+
+	var replicas int64
+	if replicas, _, err = unstructured.NestedInt64(obj.Object, cr.ReplicasPath...); err != nil {
+		return
+	}
+	wl.Replicas = int32(replicas)
+
+	wl.patch = func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) (err error) {
+		_, err = client.Resource(cr.GVR).Namespace(wl.Namespace).Patch(ctx, wl.Name, pt, data, opts)
+		return
+	}
+	return
+}
+
+// listCustomWorkloads lists all workloads of configured custom resources in a namespace,
+// failed resources are returned as an aggregate of *ListError
+func listCustomWorkloads(ctx context.Context, client dynamic.Interface, crs []CustomResource, namespace string) (wls []*Workload, err error) {
+	var errs []error
+	for _, cr := range crs {
+		var list *unstructured.UnstructuredList
+		if lErr := retryAPI(ctx, isRetriable, func() (err error) {
+			list, err = client.Resource(cr.GVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+			return
+		}); lErr != nil {
+			errs = append(errs, &ListError{Kind: cr.Kind(), Namespace: namespace, Err: lErr})
+			continue
+		}
+		for i := range list.Items {
+			var wl *Workload
+			var wlErr error
+			if wl, wlErr = newCustomWorkload(client, cr, &list.Items[i]); wlErr != nil {
+				buildLogger(cr.Kind(), list.Items[i].GetName())("invalid custom resource: " + wlErr.Error())
+				continue
+			}
+			wls = append(wls, wl)
+		}
+	}
+	err = utilerrors.NewAggregate(errs)
+	return
+}
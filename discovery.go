@@ -0,0 +1,808 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	utilspdy "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/deprecated/scheme"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DiscovererSpecEnv      = "spec-env"
+	DiscovererAnnotation   = "annotation"
+	DiscovererExecEnv      = "exec-env"
+	DiscovererExecMarker   = "exec-marker"
+	DiscovererRegistry     = "registry"
+	DiscovererScriptPrefix = "script:"
+)
+
+var (
+	optDiscoverers      = os.Getenv("AUTO_LOGTUBE_MAPPING_DISCOVERERS")
+	optDiscoveryScripts = os.Getenv("AUTO_LOGTUBE_MAPPING_DISCOVERY_SCRIPTS")
+	optExecTimeout, _   = time.ParseDuration(os.Getenv("AUTO_LOGTUBE_MAPPING_EXEC_TIMEOUT"))
+	optExecPerNode, _   = strconv.Atoi(os.Getenv("AUTO_LOGTUBE_MAPPING_EXEC_PER_NODE"))
+	optProbeWorkers, _  = strconv.Atoi(os.Getenv("AUTO_LOGTUBE_MAPPING_PROBE_WORKERS"))
+)
+
+// probeWorkers returns max number of pods probed concurrently across all workloads, 8 by default
+func probeWorkers() int {
+	if optProbeWorkers <= 0 {
+		return 8
+	}
+	return optProbeWorkers
+}
+
+// DiscoveryTarget is a container to discover log path for
+type DiscoveryTarget struct {
+	Namespace   string
+	Annotations map[string]string
+	Spec        *corev1.PodSpec
+	Container   *corev1.Container
+	// Pod a running pod of the pod template, only available for discoverers requiring pod
+	Pod *corev1.Pod
+}
+
+// Discoverer discovers log path of a container from a single source
+type Discoverer interface {
+	// Name name of the source
+	Name() string
+	// RequiresPod whether a running pod is required
+	RequiresPod() bool
+	// Discover returns log paths of the container, separated by ':', ',' or newlines, or empty string if not declared in this source
+	Discover(ctx context.Context, t *DiscoveryTarget) (string, error)
+}
+
+// imageDiscoverer is a discoverer requiring pod, but the result only depends on the container image,
+// pods running the same image are probed once
+type imageDiscoverer interface {
+	// imageKey returns the image the container of pod runs, empty if unknown
+	imageKey(t *DiscoveryTarget) string
+}
+
+// envSource loads ConfigMaps and Secrets referenced by container env
+type envSource interface {
+	configMap(ctx context.Context, namespace, name string) (map[string]string, error)
+	secret(ctx context.Context, namespace, name string) (map[string][]byte, error)
+}
+
+type clientEnvSource struct {
+	client *kubernetes.Clientset
+}
+
+func (s clientEnvSource) configMap(ctx context.Context, namespace, name string) (data map[string]string, err error) {
+	var cm *corev1.ConfigMap
+	if cm, err = s.client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+		return
+	}
+	data = cm.Data
+	return
+}
+
+func (s clientEnvSource) secret(ctx context.Context, namespace, name string) (data map[string][]byte, err error) {
+	var secret *corev1.Secret
+	if secret, err = s.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+		return
+	}
+	data = secret.Data
+	return
+}
+
+// resolveEnvFromSpec resolves an environment variable statically from container spec, following the precedence of kubelet,
+// env overrides envFrom, and the last one wins; values from ConfigMaps and Secrets are only resolved if src is not nil,
+// empty string is returned if the value can not be resolved statically
+func resolveEnvFromSpec(ctx context.Context, src envSource, namespace string, container *corev1.Container, name string) (value string, err error) {
+	isOptional := func(optional *bool) bool {
+		return optional != nil && *optional
+	}
+
+	for i := len(container.Env) - 1; i >= 0; i-- {
+		env := container.Env[i]
+		if env.Name != name {
+			continue
+		}
+		if env.ValueFrom == nil {
+			value = env.Value
+			return
+		}
+		if src == nil {
+			return
+		}
+		if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+			var data map[string]string
+			if data, err = src.configMap(ctx, namespace, ref.Name); err != nil {
+				if apierrors.IsNotFound(err) && isOptional(ref.Optional) {
+					err = nil
+				}
+				return
+			}
+			value = data[ref.Key]
+		} else if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+			var data map[string][]byte
+			if data, err = src.secret(ctx, namespace, ref.Name); err != nil {
+				if apierrors.IsNotFound(err) && isOptional(ref.Optional) {
+					err = nil
+				}
+				return
+			}
+			value = string(data[ref.Key])
+		}
+		// fieldRef and resourceFieldRef are never a log path
+		return
+	}
+
+	if src == nil {
+		return
+	}
+
+	for i := len(container.EnvFrom) - 1; i >= 0; i-- {
+		ef := container.EnvFrom[i]
+		if !strings.HasPrefix(name, ef.Prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(name, ef.Prefix)
+		if ref := ef.ConfigMapRef; ref != nil {
+			var data map[string]string
+			if data, err = src.configMap(ctx, namespace, ref.Name); err != nil {
+				if apierrors.IsNotFound(err) && isOptional(ref.Optional) {
+					err = nil
+					continue
+				}
+				return
+			}
+			var ok bool
+			if value, ok = data[key]; ok {
+				return
+			}
+		} else if ref := ef.SecretRef; ref != nil {
+			var data map[string][]byte
+			if data, err = src.secret(ctx, namespace, ref.Name); err != nil {
+				if apierrors.IsNotFound(err) && isOptional(ref.Optional) {
+					err = nil
+					continue
+				}
+				return
+			}
+			if buf, ok := data[key]; ok {
+				value = string(buf)
+				return
+			}
+		}
+	}
+	return
+}
+
+// specEnvDiscoverer resolves the environment variable from pod template, including ConfigMaps and Secrets referenced
+type specEnvDiscoverer struct {
+	src envSource
+}
+
+func (specEnvDiscoverer) Name() string {
+	return DiscovererSpecEnv
+}
+
+func (specEnvDiscoverer) RequiresPod() bool {
+	return false
+}
+
+func (d specEnvDiscoverer) Discover(ctx context.Context, t *DiscoveryTarget) (string, error) {
+	return resolveEnvFromSpec(ctx, d.src, t.Namespace, t.Container, EnvLogtubeAutoMapping)
+}
+
+type annotationDiscoverer struct{}
+
+func (annotationDiscoverer) Name() string {
+	return DiscovererAnnotation
+}
+
+func (annotationDiscoverer) RequiresPod() bool {
+	return false
+}
+
+func (annotationDiscoverer) Discover(ctx context.Context, t *DiscoveryTarget) (logPath string, err error) {
+	// io.github.logtube.auto-mapping/path.[CONTAINER]
+	if logPath = t.Annotations[AnnotationLogtubeAutoMappingPath+"."+t.Container.Name]; logPath != "" {
+		return
+	}
+	if logPath = t.Annotations[AnnotationLogtubeAutoMappingPath]; logPath == "" {
+		return
+	}
+	if len(t.Spec.Containers) != 1 {
+		logPath = ""
+		err = fmt.Errorf("annotation %s requires exactly one container, use %s.[CONTAINER] instead", AnnotationLogtubeAutoMappingPath, AnnotationLogtubeAutoMappingPath)
+		return
+	}
+	return
+}
+
+// nodeLimiter limits concurrent execs per node, so a single kubelet is not flooded
+type nodeLimiter struct {
+	limit int
+	mu    sync.Mutex
+	sems  map[string]chan struct{}
+}
+
+func newNodeLimiter(limit int) *nodeLimiter {
+	return &nodeLimiter{limit: limit, sems: map[string]chan struct{}{}}
+}
+
+// acquire blocks until a slot of node is available, release must be called after
+func (l *nodeLimiter) acquire(ctx context.Context, node string) (release func(), err error) {
+	l.mu.Lock()
+	sem, ok := l.sems[node]
+	if !ok {
+		sem = make(chan struct{}, l.limit)
+		l.sems[node] = sem
+	}
+	l.mu.Unlock()
+	select {
+	case sem <- struct{}{}:
+		release = func() { <-sem }
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// limitedBuffer keeps the first n bytes written, the rest is dropped silently
+type limitedBuffer struct {
+	bytes.Buffer
+	n int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.n - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+type execDiscoverer struct {
+	name    string
+	script  string
+	cfg     *rest.Config
+	client  *kubernetes.Clientset
+	limiter *nodeLimiter
+	timeout time.Duration
+}
+
+func (d *execDiscoverer) Name() string {
+	return d.name
+}
+
+func (d *execDiscoverer) RequiresPod() bool {
+	return true
+}
+
+// closingUpgrader keeps the SPDY connection of an exec, so it can be closed on timeout, since exec.Stream does not accept a context
+type closingUpgrader struct {
+	spdy.Upgrader
+	mu     sync.Mutex
+	conn   httpstream.Connection
+	closed bool
+}
+
+func (u *closingUpgrader) NewConnection(resp *http.Response) (conn httpstream.Connection, err error) {
+	if conn, err = u.Upgrader.NewConnection(resp); err != nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conn = conn
+	// timed out during upgrading
+	if u.closed {
+		_ = conn.Close()
+	}
+	return
+}
+
+// Close closes the connection, and the connection created later
+func (u *closingUpgrader) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	if u.conn != nil {
+		_ = u.conn.Close()
+	}
+}
+
+func (d *execDiscoverer) Discover(ctx context.Context, t *DiscoveryTarget) (logPath string, err error) {
+	var release func()
+	if release, err = d.limiter.acquire(ctx, t.Pod.Spec.NodeName); err != nil {
+		return
+	}
+
+	req := d.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(t.Pod.Name).
+		Namespace(t.Pod.Namespace).
+		SubResource("exec")
+	req.VersionedParams(&corev1.PodExecOptions{
+		Container: t.Container.Name,
+		Command:   []string{"sh"},
+		Stdin:     true,
+		Stdout:    true,
+		Stderr:    true,
+	}, scheme.ParameterCodec)
+
+	var (
+		transport http.RoundTripper
+		upgrader  spdy.Upgrader
+	)
+	if transport, upgrader, err = spdy.RoundTripperFor(d.cfg); err != nil {
+		release()
+		return
+	}
+	if rt, ok := upgrader.(*utilspdy.SpdyRoundTripper); ok {
+		rt.Dialer = &net.Dialer{Timeout: d.timeout}
+	}
+	conns := &closingUpgrader{Upgrader: upgrader}
+	var exec remotecommand.Executor
+	if exec, err = remotecommand.NewSPDYExecutorForTransports(transport, conns, "POST", req.URL()); err != nil {
+		release()
+		return
+	}
+
+	out, errOut := &limitedBuffer{n: 64 * 1024}, &limitedBuffer{n: 4 * 1024}
+
+	// the node slot is released once the stream really exits, not on timeout
+	chErr := make(chan error, 1)
+	go func() {
+		defer release()
+		chErr <- exec.Stream(remotecommand.StreamOptions{
+			Stdin:  strings.NewReader(d.script),
+			Stdout: out,
+			Stderr: errOut,
+		})
+	}()
+
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-chErr:
+	case <-timer.C:
+		conns.Close()
+		err = fmt.Errorf("exec timeout after %s", d.timeout)
+		return
+	case <-ctx.Done():
+		conns.Close()
+		err = ctx.Err()
+		return
+	}
+
+	if err != nil {
+		if stderr := strings.TrimSpace(errOut.String()); stderr != "" {
+			err = fmt.Errorf("%s, stderr: %s", err.Error(), stderr)
+		}
+		return
+	}
+	logPath = out.String()
+	return
+}
+
+func buildEnvCheckScript() string {
+	return fmt.Sprintf(`echo ${%s}`, EnvLogtubeAutoMapping)
+}
+
+func buildMarkFileCheckScript() string {
+	return fmt.Sprintf(`
+	if [ -f "%s" ]; then
+		cat "%s"
+	fi
+`, MarkFileLogtubeAutoMapping, MarkFileLogtubeAutoMapping)
+}
+
+// parseDiscoveryScripts parses custom discovery scripts, one [NAME]=[SCRIPT] per line
+func parseDiscoveryScripts(s string) (scripts map[string]string, err error) {
+	scripts = map[string]string{}
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		splits := strings.SplitN(line, "=", 2)
+		if len(splits) != 2 || strings.TrimSpace(splits[0]) == "" {
+			err = fmt.Errorf("invalid discovery script: %s", line)
+			return
+		}
+		scripts[strings.TrimSpace(splits[0])] = splits[1]
+	}
+	return
+}
+
+// newDiscoveryChain creates the ordered discoverers from --discoverers and --discovery-script,
+// custom scripts are appended to the default chain if --discoverers is not specified
+func newDiscoveryChain(cfg *rest.Config, client *kubernetes.Clientset) (chain []Discoverer, err error) {
+	var scripts map[string]string
+	if scripts, err = parseDiscoveryScripts(optDiscoveryScripts); err != nil {
+		return
+	}
+
+	var names []string
+	if optDiscoverers != "" {
+		for _, name := range strings.Split(optDiscoverers, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	} else {
+		names = []string{DiscovererSpecEnv, DiscovererAnnotation, DiscovererExecEnv, DiscovererExecMarker}
+		for name := range scripts {
+			names = append(names, DiscovererScriptPrefix+name)
+		}
+		// keep chain stable
+		sort.Strings(names[4:])
+	}
+
+	var src envSource
+	if client != nil {
+		src = clientEnvSource{client: client}
+	}
+
+	timeout := optExecTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	perNode := optExecPerNode
+	if perNode <= 0 {
+		perNode = 2
+	}
+	limiter := newNodeLimiter(perNode)
+	newExecDiscoverer := func(name, script string) Discoverer {
+		return &execDiscoverer{name: name, script: script, cfg: cfg, client: client, limiter: limiter, timeout: timeout}
+	}
+
+	for _, name := range names {
+		switch {
+		case name == DiscovererSpecEnv:
+			chain = append(chain, specEnvDiscoverer{src: src})
+		case name == DiscovererAnnotation:
+			chain = append(chain, annotationDiscoverer{})
+		case name == DiscovererExecEnv:
+			chain = append(chain, newExecDiscoverer(name, buildEnvCheckScript()))
+		case name == DiscovererExecMarker:
+			chain = append(chain, newExecDiscoverer(name, buildMarkFileCheckScript()))
+		case name == DiscovererRegistry:
+			chain = append(chain, &registryDiscoverer{src: src, client: &http.Client{Timeout: time.Minute}})
+		case strings.HasPrefix(name, DiscovererScriptPrefix):
+			script, ok := scripts[strings.TrimPrefix(name, DiscovererScriptPrefix)]
+			if !ok {
+				err = errors.New("discovery script not defined: " + name)
+				return
+			}
+			chain = append(chain, newExecDiscoverer(name, script))
+		default:
+			err = errors.New("unknown discoverer: " + name)
+			return
+		}
+	}
+	if len(chain) == 0 {
+		err = errors.New("no discoverers configured")
+	}
+	return
+}
+
+// DiscoveryResult is the log paths of a container and the source they come from
+type DiscoveryResult struct {
+	Container string
+	LogPaths  []string
+	Source    string
+	// Err discoverers failed on the container and no log path found, existing mapping of it should be kept
+	Err error
+}
+
+// splitLogPaths splits log paths separated by ':', ',' or newlines, duplicated ones are removed
+func splitLogPaths(s string) (logPaths []string) {
+	seen := map[string]bool{}
+	for _, logPath := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ':' || r == ',' || r == '\n'
+	}) {
+		if logPath = strings.TrimSpace(logPath); logPath == "" || seen[logPath] {
+			continue
+		}
+		seen[logPath] = true
+		logPaths = append(logPaths, logPath)
+	}
+	return
+}
+
+// PodListError is returned if nothing is discovered and pods could not be listed from API server
+type PodListError struct {
+	Err error
+}
+
+func (e *PodListError) Error() string {
+	return e.Err.Error()
+}
+
+// DiscoveryError is returned if nothing is discovered and discoverers failed, e.g. exec errors or timeouts,
+// forbidden pods/exec, or API errors reading ConfigMaps, Secrets and registries, rather than no log path declared
+type DiscoveryError struct {
+	Err error
+}
+
+func (e *DiscoveryError) Error() string {
+	return e.Err.Error()
+}
+
+// ConflictError is returned if pods of the same workload report different log paths
+type ConflictError struct {
+	Container string
+	Source    string
+	// LogPaths log paths reported by each pod
+	LogPaths map[string][]string
+}
+
+func (e *ConflictError) Error() string {
+	var names []string
+	for name := range e.LogPaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var items []string
+	for _, name := range names {
+		items = append(items, name+": "+strings.Join(e.LogPaths[name], ", "))
+	}
+	return fmt.Sprintf("container [%s] (%s): pods report different log paths, %s", e.Container, e.Source, strings.Join(items, "; "))
+}
+
+// Discovery runs a chain of discoverers against containers of a pod template
+type Discovery struct {
+	Chain       []Discoverer
+	Namespace   string
+	Annotations map[string]string
+	Spec        *corev1.PodSpec
+	// Pods returns running pods for discoverers requiring pod, discoverers requiring pod are skipped if nil
+	Pods func(ctx context.Context) ([]*corev1.Pod, error)
+	// Log logs per container discovery
+	Log func(s string)
+	// Cache caches results of discoverers requiring pod by image digest, optional
+	Cache DiscoveryCache
+	// Probes bounds concurrent probes of pods across workloads, unbounded if nil
+	Probes chan struct{}
+}
+
+// lookupCache returns the cached entry of a container, all pods must have a known image digest with the same entry
+func lookupCache(cache DiscoveryCache, pods []*corev1.Pod, containerName string) (entry CacheEntry, ok bool) {
+	if len(pods) == 0 {
+		return
+	}
+	for i, pod := range pods {
+		digest := containerImageDigest(pod, containerName)
+		if digest == "" {
+			return CacheEntry{}, false
+		}
+		current, found := cache.Get(buildCacheKey(digest, containerName))
+		if !found {
+			return CacheEntry{}, false
+		}
+		if i > 0 && strings.Join(current.LogPaths, "\n") != strings.Join(entry.LogPaths, "\n") {
+			return CacheEntry{}, false
+		}
+		entry = current
+	}
+	ok = true
+	return
+}
+
+// storeCache saves discovered log paths for image digests of all pods
+func storeCache(cache DiscoveryCache, pods []*corev1.Pod, containerName string, entry CacheEntry) {
+	for _, pod := range pods {
+		if digest := containerImageDigest(pod, containerName); digest != "" {
+			cache.Set(buildCacheKey(digest, containerName), entry)
+		}
+	}
+}
+
+// discoverPods runs a discoverer requiring pod against every pod in parallel, all pods must report the same log paths,
+// concurrent probes are bounded by probes across workloads if not nil, and by the node limiter of exec discoverers,
+// pods running the same image share a single probe of image discoverers
+func discoverPods(ctx context.Context, dc Discoverer, t DiscoveryTarget, pods []*corev1.Pod, probes chan struct{}) (logPaths []string, err error) {
+	// group pods by image for image discoverers, or one group per pod
+	var groups [][]int
+	byImage := map[string]int{}
+	for i, pod := range pods {
+		if id, ok := dc.(imageDiscoverer); ok {
+			pt := t
+			pt.Pod = pod
+			if key := id.imageKey(&pt); key != "" {
+				if g, ok := byImage[key]; ok {
+					groups[g] = append(groups[g], i)
+					continue
+				}
+				byImage[key] = len(groups)
+			}
+		}
+		groups = append(groups, []int{i})
+	}
+
+	reported := make([][]string, len(pods))
+	errs := make([]error, len(pods))
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		if probes != nil {
+			select {
+			case probes <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				err = ctx.Err()
+				return
+			}
+		}
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			if probes != nil {
+				defer func() { <-probes }()
+			}
+			pt := t
+			pt.Pod = pods[group[0]]
+			logPath, dErr := dc.Discover(ctx, &pt)
+			for _, i := range group {
+				if dErr != nil {
+					errs[i] = fmt.Errorf("pod [%s]: %s", pt.Pod.Name, dErr.Error())
+					continue
+				}
+				reported[i] = splitLogPaths(logPath)
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	for _, dErr := range errs {
+		if dErr != nil {
+			err = dErr
+			return
+		}
+	}
+	var conflict bool
+	for i, current := range reported {
+		if i > 0 && strings.Join(current, "\n") != strings.Join(logPaths, "\n") {
+			conflict = true
+		}
+		logPaths = current
+	}
+	if conflict {
+		byPod := map[string][]string{}
+		for i, pod := range pods {
+			byPod[pod.Name] = reported[i]
+		}
+		logPaths = nil
+		err = &ConflictError{Container: t.Container.Name, Source: dc.Name(), LogPaths: byPod}
+	}
+	return
+}
+
+// Run walks through containers, each container is checked by discoverers in order, until a log path is found,
+// containers failed to discover are returned with Err if others are discovered,
+// a *ConflictError is returned immediately if pods disagree with each other
+func (d *Discovery) Run(ctx context.Context) (results []DiscoveryResult, err error) {
+	var (
+		pods         []*corev1.Pod
+		podsErr      error
+		podsResolved bool
+	)
+
+	var errs []string
+	var failed []DiscoveryResult
+
+	for i := range d.Spec.Containers {
+		container := &d.Spec.Containers[i]
+
+		var found, cacheChecked bool
+		var cErrs []string
+		for _, dc := range d.Chain {
+			t := DiscoveryTarget{
+				Namespace:   d.Namespace,
+				Annotations: d.Annotations,
+				Spec:        d.Spec,
+				Container:   container,
+			}
+			var (
+				logPaths []string
+				dErr     error
+				source   = dc.Name()
+			)
+			if dc.RequiresPod() {
+				if d.Pods == nil {
+					continue
+				}
+				if !podsResolved {
+					pods, podsErr = d.Pods(ctx)
+					podsResolved = true
+					if podsErr != nil {
+						errs = append(errs, "pod: "+podsErr.Error())
+					}
+				}
+				if podsErr != nil {
+					continue
+				}
+				// image digests unchanged since last discovery, skip probing pods
+				if d.Cache != nil && !cacheChecked {
+					cacheChecked = true
+					if entry, ok := lookupCache(d.Cache, pods, container.Name); ok {
+						logPaths, source = entry.LogPaths, "cache ("+entry.Source+")"
+					}
+				}
+				if len(logPaths) == 0 {
+					if logPaths, dErr = discoverPods(ctx, dc, t, pods, d.Probes); dErr != nil {
+						if _, ok := dErr.(*ConflictError); ok {
+							results = nil
+							err = dErr
+							return
+						}
+					} else if d.Cache != nil && len(logPaths) > 0 {
+						storeCache(d.Cache, pods, container.Name, CacheEntry{LogPaths: logPaths, Source: source})
+					}
+				}
+			} else {
+				var logPath string
+				logPath, dErr = dc.Discover(ctx, &t)
+				logPaths = splitLogPaths(logPath)
+			}
+			if dErr != nil {
+				cErrs = append(cErrs, fmt.Sprintf("%s (%s): %s", container.Name, dc.Name(), dErr.Error()))
+				continue
+			}
+			if len(logPaths) == 0 {
+				continue
+			}
+			if d.Log != nil {
+				d.Log(fmt.Sprintf("container [%s]: %s (%s)", container.Name, strings.Join(logPaths, ", "), source))
+			}
+			results = append(results, DiscoveryResult{Container: container.Name, LogPaths: logPaths, Source: source})
+			found = true
+			break
+		}
+
+		if found {
+			continue
+		}
+		if len(cErrs) > 0 {
+			errs = append(errs, cErrs...)
+			failed = append(failed, DiscoveryResult{Container: container.Name, Err: errors.New(strings.Join(cErrs, "; "))})
+		}
+		if d.Log != nil {
+			d.Log(fmt.Sprintf("container [%s]: no log path", container.Name))
+		}
+	}
+
+	if len(results) > 0 {
+		results = append(results, failed...)
+		return
+	}
+
+	if len(errs) > 0 {
+		err = errors.New("no log path discovered: " + strings.Join(errs, "; "))
+	} else {
+		err = errors.New("no log path discovered")
+	}
+	// listing pods failed even after retries, or discoverers failed, a failure rather than a discovery miss
+	if _, ok := podsErr.(apierrors.APIStatus); ok {
+		err = &PodListError{Err: err}
+	} else if len(failed) > 0 {
+		err = &DiscoveryError{Err: err}
+	}
+	return
+}
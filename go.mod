@@ -3,7 +3,9 @@ module github.com/logtube/auto-logtube-mapping
 go 1.14
 
 require (
+	github.com/pmezard/go-difflib v1.0.0
 	k8s.io/api v0.18.8
 	k8s.io/apimachinery v0.18.8
 	k8s.io/client-go v0.18.8
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+var (
+	optLeaderElect, _     = strconv.ParseBool(os.Getenv("AUTO_LOGTUBE_MAPPING_LEADER_ELECT"))
+	optLeaderElectLease   = os.Getenv("AUTO_LOGTUBE_MAPPING_LEADER_ELECT_LEASE")
+	optLeaderElectLeaseNS = os.Getenv("AUTO_LOGTUBE_MAPPING_LEADER_ELECT_NAMESPACE")
+)
+
+// leaseNamespace returns namespace of the lease, defaults to namespace of the service account
+func leaseNamespace() string {
+	if optLeaderElectLeaseNS != "" {
+		return optLeaderElectLeaseNS
+	}
+	return currentNamespace()
+}
+
+// currentNamespace returns namespace of the service account, "default" if not running in cluster
+func currentNamespace() string {
+	if buf, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if ns := strings.TrimSpace(string(buf)); ns != "" {
+			return ns
+		}
+	}
+	return "default"
+}
+
+// runWithLeaderElection blocks until a coordination.k8s.io Lease is acquired, then invokes run,
+// the lease is released once run returns
+func runWithLeaderElection(ctx context.Context, client *kubernetes.Clientset, run func(ctx context.Context) error) (err error) {
+	name := optLeaderElectLease
+	if name == "" {
+		name = "auto-logtube-mapping"
+	}
+	var identity string
+	if identity, err = os.Hostname(); err != nil {
+		return
+	}
+	identity = identity + "_" + strconv.Itoa(os.Getpid())
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: leaseNamespace(),
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	leCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chStarted := make(chan struct{})
+	chErr := make(chan error, 1)
+
+	var le *leaderelection.LeaderElector
+	if le, err = leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(runCtx context.Context) {
+				log.Printf("leader election: acquired lease %s/%s", lock.LeaseMeta.Namespace, name)
+				close(chStarted)
+				runErr := run(runCtx)
+				// runCtx is cancelled by elector when lease is lost
+				if runErr == nil && runCtx.Err() != nil && ctx.Err() == nil {
+					runErr = errors.New("leader election lost")
+				}
+				chErr <- runErr
+				cancel()
+			},
+			OnStoppedLeading: func() {
+				log.Printf("leader election: released lease %s/%s", lock.LeaseMeta.Namespace, name)
+			},
+			OnNewLeader: func(current string) {
+				if current != identity {
+					log.Printf("leader election: current leader is %s", current)
+				}
+			},
+		},
+	}); err != nil {
+		return
+	}
+
+	log.Printf("leader election: acquiring lease %s/%s as %s", lock.LeaseMeta.Namespace, name, identity)
+	le.Run(leCtx)
+
+	select {
+	case <-chStarted:
+		err = <-chErr
+	default:
+	}
+	return
+}
@@ -1,28 +1,31 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	appsv1 "k8s.io/api/apps/v1"
+	"hash/fnv"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/deprecated/scheme"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/remotecommand"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 const (
 	AnnotationLogtubeAutoMappingEnabled = "io.github.logtube.auto-mapping/enabled"
+	AnnotationLogtubeAutoMappingPath    = "io.github.logtube.auto-mapping/path"
 
 	VolumeNameLogtubeAutoMapping = "vol-logtube-auto-mapping"
 
@@ -30,23 +33,32 @@ const (
 
 	EnvLogtubeAutoMapping  = "LOGTUBE_K8S_AUTO_MAPPING"
 	EnvLogtubeLogsHostPath = "LOGTUBE_LOGS_HOST_PATH"
+
+	ModeOnce       = "once"
+	ModeController = "controller"
+	ModeWebhook    = "webhook"
 )
 
 var (
 	optDryRun, _ = strconv.ParseBool(os.Getenv("AUTO_LOGTUBE_MAPPING_DRY_RUN"))
+	// optValidate sends patches with server-side dry run, set by the validate command
+	optValidate  bool
 	optHostPath  = os.Getenv(EnvLogtubeLogsHostPath)
+	optMode      = os.Getenv("AUTO_LOGTUBE_MAPPING_MODE")
+	optNamespace = os.Getenv("AUTO_LOGTUBE_MAPPING_NAMESPACE")
+
+	optWorkers, _ = strconv.Atoi(os.Getenv("AUTO_LOGTUBE_MAPPING_WORKERS"))
+
+	optKubeconfig string
+	optContext    string
 )
 
-func buildLogPathCheckScript() string {
-	return fmt.Sprintf(`
-	if [ -n "${%s}" ]; then
-		echo ${%s}
-	else
-		if [ -f "%s" ]; then
-			cat "%s"
-		fi
-	fi
-`, EnvLogtubeAutoMapping, EnvLogtubeAutoMapping, MarkFileLogtubeAutoMapping, MarkFileLogtubeAutoMapping)
+// numWorkers returns number of workloads processed concurrently, 2 by default
+func numWorkers() int {
+	if optWorkers <= 0 {
+		return 2
+	}
+	return optWorkers
 }
 
 type WorkloadPatch struct {
@@ -56,102 +68,338 @@ type WorkloadPatch struct {
 
 	namespace string
 	name      string
+	// kept containers failed to discover, existing volume mounts of them are left as they are
+	kept map[string]bool
 }
 
 func newWorkloadPatch(namespace, name string) *WorkloadPatch {
 	var wp WorkloadPatch
-	hostPathType := corev1.HostPathDirectoryOrCreate
 	wp.namespace = namespace
 	wp.name = name
-	wp.Spec.Template.Spec.Volumes = []corev1.Volume{
-		{Name: VolumeNameLogtubeAutoMapping, VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{
-			Path: optHostPath + "/" + namespace + "-" + name,
-			Type: &hostPathType,
-		}}},
-	}
+	wp.kept = map[string]bool{}
 	return &wp
 }
 
+// buildVolumeName returns the auto mapping volume name of a container, volume name must be a DNS-1123 label,
+// long container names are truncated and suffixed with hash to keep them distinct
+func buildVolumeName(containerName string) string {
+	name := VolumeNameLogtubeAutoMapping + "-" + containerName
+	if len(name) <= validation.DNS1123LabelMaxLength {
+		return name
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(containerName))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	return strings.TrimRight(name[:validation.DNS1123LabelMaxLength-len(suffix)], "-") + suffix
+}
+
 func (wp *WorkloadPatch) jsonMarshal() ([]byte, error) {
 	return json.Marshal(wp)
 }
 
-func (wp *WorkloadPatch) updateVolumeMounts(cfg *rest.Config, client *kubernetes.Clientset, selectorLabels map[string]string) (err error) {
-	// check selectorLabels
-	if len(selectorLabels) == 0 {
-		err = fmt.Errorf("%s/%s: no selector labels", wp.namespace, wp.name)
-		return
+// jsonMarshalAt marshals the patch with pod template nested at path, spec.template if path is empty
+func (wp *WorkloadPatch) jsonMarshalAt(path []string) ([]byte, error) {
+	if len(path) == 0 {
+		return wp.jsonMarshal()
 	}
-	// list pods
-	var podList *corev1.PodList
-	if podList, err = client.CoreV1().Pods(wp.namespace).List(
-		context.Background(),
-		metav1.ListOptions{LabelSelector: buildSelector(selectorLabels)},
-	); err != nil {
-		return
+	return json.Marshal(nestAt(path, wp.Spec.Template))
+}
+
+// nestAt wraps v with nested maps, keyed by each element of path
+func nestAt(path []string, v interface{}) interface{} {
+	for i := len(path) - 1; i >= 0; i-- {
+		v = map[string]interface{}{path[i]: v}
 	}
-	if len(podList.Items) == 0 {
-		err = fmt.Errorf("%s/%s: no pods", wp.namespace, wp.name)
-		return
+	return v
+}
+
+// buildSubPath converts a log path to a sub directory name, /work/gc-logs becomes work-gc-logs
+func buildSubPath(logPath string) string {
+	sb := &strings.Builder{}
+	var dash bool
+	for _, r := range strings.ToLower(logPath) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '_' {
+			sb.WriteRune(r)
+			dash = false
+		} else if sb.Len() > 0 && !dash {
+			sb.WriteRune('-')
+			dash = true
+		}
 	}
-	// one pod
-	pod := podList.Items[0]
-	for _, container := range pod.Spec.Containers {
-		// execute
-		req := client.CoreV1().RESTClient().Post().
-			Resource("pods").
-			Name(pod.Name).
-			Namespace(pod.Namespace).
-			SubResource("exec")
-		req.VersionedParams(&corev1.PodExecOptions{
-			Container: container.Name,
-			Command:   []string{"sh"},
-			Stdin:     true,
-			Stdout:    true,
-			Stderr:    true,
-		}, scheme.ParameterCodec)
-		var exec remotecommand.Executor
-		if exec, err = remotecommand.NewSPDYExecutor(cfg, "POST", req.URL()); err != nil {
-			return
+	subPath := strings.Trim(sb.String(), "-.")
+	if subPath == "" {
+		subPath = "root"
+	}
+	return subPath
+}
+
+// addVolumeMount adds a dedicated volume for the container, at host path [HOST PATH]/[NAMESPACE]-[NAME]/[CONTAINER],
+// if multiple log paths are given, each one is mounted with sub path in its own sub directory
+func (wp *WorkloadPatch) addVolumeMount(containerName string, logPaths []string) {
+	hostPathType := corev1.HostPathDirectoryOrCreate
+	volumeName := buildVolumeName(containerName)
+	wp.Spec.Template.Spec.Volumes = append(wp.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: volumeName,
+		VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{
+			Path: optHostPath + "/" + wp.namespace + "-" + wp.name + "/" + containerName,
+			Type: &hostPathType,
+		}},
+	})
+	container := corev1.Container{Name: containerName}
+	if len(logPaths) == 1 {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{MountPath: logPaths[0], Name: volumeName})
+	} else {
+		subPaths := map[string]bool{}
+		for _, logPath := range logPaths {
+			subPath := buildSubPath(logPath)
+			// /work/logs and /work-logs share the same sub path
+			for i := 2; subPaths[subPath]; i++ {
+				subPath = buildSubPath(logPath) + "-" + strconv.Itoa(i)
+			}
+			subPaths[subPath] = true
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{MountPath: logPath, Name: volumeName, SubPath: subPath})
 		}
-		out := &bytes.Buffer{}
-		if err = exec.Stream(remotecommand.StreamOptions{
-			Stdin:  strings.NewReader(fmt.Sprintf("echo ${%s}", EnvLogtubeAutoMapping)),
-			Stdout: out,
-			Stderr: ioutil.Discard,
-		}); err != nil {
-			return
+	}
+	wp.Spec.Template.Spec.Containers = append(wp.Spec.Template.Spec.Containers, container)
+}
+
+// JSONPatchOperation a RFC 6902 operation
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// jsonPatch converts the patch to RFC 6902 operations against an existing pod spec located at prefix,
+// volumes and volume mounts already existed are skipped, or replaced if different,
+// auto mapping volumes and volume mounts no longer desired are removed
+func (wp *WorkloadPatch) jsonPatch(prefix string, spec *corev1.PodSpec) (ops []JSONPatchOperation) {
+	volumes := spec.Volumes
+	for _, v := range wp.Spec.Template.Spec.Volumes {
+		idx := -1
+		for i, ev := range volumes {
+			if ev.Name == v.Name {
+				idx = i
+				break
+			}
 		}
-		logPath := strings.TrimSpace(out.String())
-		if logPath == "" {
+		if idx >= 0 {
+			if !sameVolume(&volumes[idx], &v) {
+				ops = append(ops, JSONPatchOperation{Op: "replace", Path: prefix + "/volumes/" + strconv.Itoa(idx), Value: v})
+			}
 			continue
 		}
-		wp.Spec.Template.Spec.Containers = append(wp.Spec.Template.Spec.Containers, corev1.Container{
-			Name: container.Name,
-			VolumeMounts: []corev1.VolumeMount{
-				{MountPath: logPath, Name: VolumeNameLogtubeAutoMapping},
-			},
-		})
-		return
+		if len(volumes) == 0 {
+			ops = append(ops, JSONPatchOperation{Op: "add", Path: prefix + "/volumes", Value: []corev1.Volume{v}})
+		} else {
+			ops = append(ops, JSONPatchOperation{Op: "add", Path: prefix + "/volumes/-", Value: v})
+		}
+		volumes = append(volumes, v)
 	}
-	if len(wp.Spec.Template.Spec.Containers) == 0 {
-		err = errors.New("no volume mounts updated")
-		return
+	for _, c := range wp.Spec.Template.Spec.Containers {
+		for i, ec := range spec.Containers {
+			if ec.Name != c.Name {
+				continue
+			}
+			mounts := ec.VolumeMounts
+			path := prefix + "/containers/" + strconv.Itoa(i) + "/volumeMounts"
+			for _, vm := range c.VolumeMounts {
+				idx := -1
+				for j, evm := range mounts {
+					if evm.MountPath == vm.MountPath {
+						idx = j
+						break
+					}
+				}
+				if idx >= 0 {
+					if !sameVolumeMount(&mounts[idx], &vm) {
+						ops = append(ops, JSONPatchOperation{Op: "replace", Path: path + "/" + strconv.Itoa(idx), Value: vm})
+					}
+					continue
+				}
+				if len(mounts) == 0 {
+					ops = append(ops, JSONPatchOperation{Op: "add", Path: path, Value: []corev1.VolumeMount{vm}})
+				} else {
+					ops = append(ops, JSONPatchOperation{Op: "add", Path: path + "/-", Value: vm})
+				}
+				mounts = append(mounts, vm)
+			}
+		}
+	}
+	// entries are only appended above, indexes of stale ones are still valid, remove from the tail, or indexes shift
+	staleMounts, staleVolumes := wp.stale(spec)
+	for i := range spec.Containers {
+		for j := len(staleMounts[i]) - 1; j >= 0; j-- {
+			ops = append(ops, JSONPatchOperation{Op: "remove", Path: prefix + "/containers/" + strconv.Itoa(i) + "/volumeMounts/" + strconv.Itoa(staleMounts[i][j])})
+		}
+	}
+	for i := len(staleVolumes) - 1; i >= 0; i-- {
+		ops = append(ops, JSONPatchOperation{Op: "remove", Path: prefix + "/volumes/" + strconv.Itoa(staleVolumes[i])})
 	}
 	return
 }
 
-func buildSelector(m map[string]string) string {
-	sb := &strings.Builder{}
-	for k, v := range m {
-		if sb.Len() > 0 {
-			sb.WriteRune(',')
+// sameVolume compares the host path of volumes
+func sameVolume(a, b *corev1.Volume) bool {
+	if a.HostPath == nil || b.HostPath == nil {
+		return a.HostPath == b.HostPath
+	}
+	return a.HostPath.Path == b.HostPath.Path
+}
+
+// sameVolumeMount compares volume name and sub path of volume mounts at the same mount path
+func sameVolumeMount(a, b *corev1.VolumeMount) bool {
+	return a.Name == b.Name && a.SubPath == b.SubPath
+}
+
+// compare compares the desired volumes and volume mounts with an existing pod spec, returns ResultCreated
+// if no auto mapping volume exists yet, ResultUnchanged if everything is in place, ResultUpdated otherwise,
+// including stale auto mapping volumes and volume mounts left
+func (wp *WorkloadPatch) compare(spec *corev1.PodSpec) string {
+	var mapped bool
+	for _, v := range spec.Volumes {
+		if isAutoMappingVolume(v.Name) {
+			mapped = true
+			break
+		}
+	}
+	if !mapped {
+		return ResultCreated
+	}
+	if len(wp.jsonPatch("", spec)) > 0 {
+		return ResultUpdated
+	}
+	return ResultUnchanged
+}
+
+// stale returns indexes of auto mapping volume mounts no longer desired, by container index, and indexes of
+// auto mapping volumes no longer desired nor referenced, including the legacy single volume, all in ascending order,
+// indexes are valid for both the pod spec and the merged one, since merge only appends
+func (wp *WorkloadPatch) stale(spec *corev1.PodSpec) (mounts map[int][]int, volumes []int) {
+	merged := wp.merge(spec)
+
+	desired := map[string]map[string]bool{}
+	for _, c := range wp.Spec.Template.Spec.Containers {
+		desired[c.Name] = map[string]bool{}
+		for _, vm := range c.VolumeMounts {
+			desired[c.Name][vm.MountPath] = true
+		}
+	}
+
+	mounts = map[int][]int{}
+	referenced := map[string]bool{}
+	for i, c := range merged.Containers {
+		for j, vm := range c.VolumeMounts {
+			if isAutoMappingVolume(vm.Name) && !wp.kept[c.Name] && !desired[c.Name][vm.MountPath] {
+				mounts[i] = append(mounts[i], j)
+				continue
+			}
+			referenced[vm.Name] = true
+		}
+	}
+	for _, c := range merged.InitContainers {
+		for _, vm := range c.VolumeMounts {
+			referenced[vm.Name] = true
+		}
+	}
+
+	for i, v := range merged.Volumes {
+		if i < len(spec.Volumes) && isAutoMappingVolume(v.Name) && !referenced[v.Name] {
+			volumes = append(volumes, i)
 		}
-		sb.WriteString(k)
-		sb.WriteRune('=')
-		sb.WriteString(v)
 	}
-	return sb.String()
+	return
+}
+
+// mergeInto returns a copy of the pod spec with volumes and volume mounts of the patch applied,
+// entries are replaced by volume name and mount path, the same as the patch sent to cluster,
+// stale auto mapping volumes and volume mounts are removed
+func (wp *WorkloadPatch) mergeInto(spec *corev1.PodSpec) *corev1.PodSpec {
+	mounts, volumes := wp.stale(spec)
+	out := wp.merge(spec)
+	for i, idxs := range mounts {
+		ec := &out.Containers[i]
+		for j := len(idxs) - 1; j >= 0; j-- {
+			ec.VolumeMounts = append(ec.VolumeMounts[:idxs[j]], ec.VolumeMounts[idxs[j]+1:]...)
+		}
+	}
+	for i := len(volumes) - 1; i >= 0; i-- {
+		out.Volumes = append(out.Volumes[:volumes[i]], out.Volumes[volumes[i]+1:]...)
+	}
+	return out
+}
+
+// merge returns a copy of the pod spec with volumes and volume mounts of the patch applied,
+// existing volumes keep their indexes
+func (wp *WorkloadPatch) merge(spec *corev1.PodSpec) *corev1.PodSpec {
+	out := spec.DeepCopy()
+	for _, v := range wp.Spec.Template.Spec.Volumes {
+		idx := -1
+		for i, ev := range out.Volumes {
+			if ev.Name == v.Name {
+				idx = i
+				break
+			}
+		}
+		if idx >= 0 {
+			out.Volumes[idx] = *v.DeepCopy()
+		} else {
+			out.Volumes = append(out.Volumes, *v.DeepCopy())
+		}
+	}
+	for _, c := range wp.Spec.Template.Spec.Containers {
+		for i := range out.Containers {
+			ec := &out.Containers[i]
+			if ec.Name != c.Name {
+				continue
+			}
+			for _, vm := range c.VolumeMounts {
+				idx := -1
+				for j, evm := range ec.VolumeMounts {
+					if evm.MountPath == vm.MountPath {
+						idx = j
+						break
+					}
+				}
+				if idx >= 0 {
+					ec.VolumeMounts[idx] = vm
+				} else {
+					ec.VolumeMounts = append(ec.VolumeMounts, vm)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// applyDiscoveryResults adds volume mounts for discovered log paths, containers failed to discover are kept as they are
+func (wp *WorkloadPatch) applyDiscoveryResults(results []DiscoveryResult) {
+	for _, res := range results {
+		if res.Err != nil {
+			wp.kept[res.Container] = true
+			continue
+		}
+		wp.addVolumeMount(res.Container, res.LogPaths)
+	}
+}
+
+// buildSelector converts a label selector, including matchExpressions, to string form,
+// nil or empty selector is rejected, since it matches all pods in namespace
+func buildSelector(ls *metav1.LabelSelector) (s string, err error) {
+	if ls == nil {
+		err = errors.New("no selector")
+		return
+	}
+	var selector labels.Selector
+	if selector, err = metav1.LabelSelectorAsSelector(ls); err != nil {
+		return
+	}
+	if selector.Empty() {
+		err = errors.New("empty selector")
+		return
+	}
+	s = selector.String()
+	return
 }
 
 func buildLoggerWhitespaces(l int) string {
@@ -188,114 +436,258 @@ func exit(err *error) {
 	}
 }
 
-func main() {
-	log.SetOutput(os.Stdout)
-	log.SetFlags(log.Ltime | log.Lmsgprefix)
-	if optDryRun {
-		log.SetPrefix("(dry) ")
-	}
+// Mapper discovers log paths of workloads and patches them
+type Mapper struct {
+	cfg    *rest.Config
+	client *kubernetes.Clientset
+	chain  []Discoverer
+	cache  DiscoveryCache
+	report *Report
+	// probes bounds concurrent probes of pods across workloads
+	probes chan struct{}
+}
 
-	var err error
-	defer exit(&err)
+func newMapper(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset) (m *Mapper, err error) {
+	m = &Mapper{cfg: cfg, client: client, probes: make(chan struct{}, probeWorkers())}
+	if m.chain, err = newDiscoveryChain(cfg, client); err != nil {
+		return
+	}
+	// fail fast on invalid --probe-pods
+	if _, err = probePodsLimit(); err != nil {
+		return
+	}
+	if optCacheConfigMap != "" {
+		m.cache = newConfigMapCache(ctx, client, optCacheConfigMap)
+	}
+	return
+}
 
-	if optHostPath == "" {
-		err = errors.New("missing environment variable: " + EnvLogtubeLogsHostPath)
+// saveCache persists the discovery cache, failures are logged only, as the cache is best effort
+func (m *Mapper) saveCache(ctx context.Context) {
+	if m.cache == nil || optDryRun || optValidate {
 		return
 	}
+	if err := m.cache.Save(ctx); err != nil {
+		log.Println("failed to save discovery cache: " + err.Error())
+	}
+}
 
-	var cfg *rest.Config
-	if cfg, err = rest.InClusterConfig(); err != nil {
+// processWorkload discovers the log path of an enabled workload and patches it
+func (m *Mapper) processWorkload(ctx context.Context, wl *Workload) (err error) {
+	scopeLog := buildLogger(wl.Kind, wl.Name)
+	// remove mapping of workloads opted out
+	if !wl.enabled() {
+		if wl.mapped() && !wl.Immutable {
+			if err = unmapWorkload(ctx, wl); err != nil {
+				m.report.add(wl, ResultFailed, err.Error())
+				return
+			}
+			m.report.add(wl, ResultUnmapped, "opted out")
+		}
 		return
 	}
-	var client *kubernetes.Clientset
-	if client, err = kubernetes.NewForConfig(cfg); err != nil {
+	// check pod template mutable
+	if wl.Immutable {
+		scopeLog("pod template is immutable, use webhook mode instead")
+		m.report.add(wl, ResultSkipped, "pod template is immutable")
 		return
 	}
-
-	var nsList *corev1.NamespaceList
-	if nsList, err = client.CoreV1().Namespaces().List(context.Background(), metav1.ListOptions{}); err != nil {
+	d := &Discovery{
+		Chain:       m.chain,
+		Namespace:   wl.Namespace,
+		Annotations: wl.Annotations,
+		Spec:        &wl.Template.Spec,
+		Log:         scopeLog,
+		Cache:       m.cache,
+		Probes:      m.probes,
+	}
+	// pods are short-lived, discoverers requiring pod are skipped
+	if !wl.SpecOnly {
+		d.Pods = func(ctx context.Context) ([]*corev1.Pod, error) {
+			return wl.findPods(ctx, m.client, scopeLog)
+		}
+	}
+	var results []DiscoveryResult
+	if results, err = d.Run(ctx); err != nil {
+		switch err.(type) {
+		case *ConflictError:
+			scopeLog("conflicting, skipped: " + err.Error())
+			m.report.add(wl, ResultConflicting, err.Error())
+		case *PodListError:
+			scopeLog("failed to list pods: " + err.Error())
+			m.report.add(wl, ResultFailed, err.Error())
+		case *DiscoveryError:
+			scopeLog("failed to discover: " + err.Error())
+			m.report.add(wl, ResultFailed, err.Error())
+		default:
+			// scaled to zero, no ready pod, or no log path declared, not a failure
+			scopeLog("skipped: " + err.Error())
+			m.report.add(wl, ResultSkipped, err.Error())
+		}
+		err = nil
 		return
 	}
-
-	for _, ns := range nsList.Items {
-		log.Printf("namespace: [%s]", ns.Name)
-
-		var dpList *appsv1.DeploymentList
-		if dpList, err = client.AppsV1().Deployments(ns.Name).List(context.Background(), metav1.ListOptions{}); err != nil {
+	wp := newWorkloadPatch(wl.Namespace, wl.Name)
+	wp.applyDiscoveryResults(results)
+	state := wp.compare(&wl.Template.Spec)
+	// mapped by a strategic merge patch before, apply once more to take the ownership, reported as unchanged
+	if state == ResultUnchanged && (!wl.serverSide() || wl.appliedBy(FieldManagerLogtubeAutoMapping)) {
+		scopeLog("already mapped")
+		m.report.add(wl, ResultUnchanged, "")
+		return
+	}
+	var pt types.PatchType
+	var patch []byte
+	opts := metav1.PatchOptions{}
+	// server-side apply never removes fields owned by others, stale volumes and volume mounts are removed with JSON patch first
+	if mounts, volumes := wp.stale(&wl.Template.Spec); wl.serverSide() && len(mounts) == 0 && len(volumes) == 0 {
+		pt, opts.FieldManager = types.ApplyPatchType, FieldManagerLogtubeAutoMapping
+		patch, err = wl.buildApplyPatch(wp)
+	} else {
+		pt, patch, err = wl.buildPatch(wp)
+	}
+	if err != nil {
+		m.report.add(wl, ResultFailed, err.Error())
+		return
+	}
+	entry := ReportEntry{Kind: wl.Kind, Namespace: wl.Namespace, Name: wl.Name, Result: state, PatchType: string(pt), Patch: patch}
+	// execute patch
+	if optDryRun {
+		if entry.Diff, err = buildSpecDiff(&wl.Template.Spec, wp.mergeInto(&wl.Template.Spec)); err != nil {
+			m.report.add(wl, ResultFailed, err.Error())
 			return
 		}
-
-		for _, dp := range dpList.Items {
-			scopeLog := buildLogger("deployment", dp.Name)
-			// check annotations exists
-			if dp.Annotations == nil {
-				continue
-			}
-			// check enabled
-			if enabled, _ := strconv.ParseBool(dp.Annotations[AnnotationLogtubeAutoMappingEnabled]); !enabled {
-				continue
-			}
-			// check status.replicas
-			if dp.Status.Replicas == 0 {
-				scopeLog("status.replicas == 0")
-				continue
+		// with --output json, diff and patch are printed in the report document
+		if optOutput != OutputJSON || m.report == nil {
+			logDryRun(scopeLog, &entry)
+		}
+	} else if optValidate {
+		// admission and validation errors are collected, instead of aborting the run
+		opts.DryRun = []string{metav1.DryRunAll}
+		if vErr := wl.patchRetrying(ctx, pt, patch, opts); vErr != nil {
+			if pt == types.ApplyPatchType && apierrors.IsConflict(vErr) {
+				scopeLog("conflicting with other field managers: " + vErr.Error())
+				entry.Result = ResultConflicting
+			} else {
+				scopeLog("invalid: " + vErr.Error())
+				entry.Result = ResultInvalid
 			}
-			wp := newWorkloadPatch(dp.Namespace, dp.Name)
-			if err = wp.updateVolumeMounts(cfg, client, dp.Spec.Selector.MatchLabels); err != nil {
-				scopeLog("failed to update volume mounts: " + err.Error())
+			entry.Message = vErr.Error()
+			m.report.addEntry(entry)
+			return
+		}
+		scopeLog("valid, mapping " + state)
+		m.report.addEntry(entry)
+		return
+	} else {
+		if err = wl.patchRetrying(ctx, pt, patch, opts); err != nil {
+			// fields owned by other managers, e.g. helm or kubectl, are never overwritten
+			if pt == types.ApplyPatchType && apierrors.IsConflict(err) {
+				scopeLog("conflicting with other field managers, skipped: " + err.Error())
+				m.report.add(wl, ResultConflicting, err.Error())
 				err = nil
-				continue
-			}
-			var patch []byte
-			if patch, err = wp.jsonMarshal(); err != nil {
 				return
 			}
-			// execute patch
-			if !optDryRun {
-				if _, err = client.AppsV1().Deployments(dp.Namespace).Patch(context.Background(), dp.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
-					return
-				}
-			}
-			scopeLog("patched")
+			m.report.add(wl, ResultFailed, err.Error())
+			return
 		}
+	}
+	scopeLog("patched, mapping " + state)
+	m.report.addEntry(entry)
+	return
+}
 
-		var stList *appsv1.StatefulSetList
-		if stList, err = client.AppsV1().StatefulSets(ns.Name).List(context.Background(), metav1.ListOptions{}); err != nil {
-			return
+// runOnce walks through all namespaces once, the classic CronJob mode
+func runOnce(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset) (err error) {
+	var m *Mapper
+	if m, err = newMapper(ctx, cfg, client); err != nil {
+		return
+	}
+	m.report = &Report{}
+
+	// process workloads with a bounded pool, a failed workload is recorded in report and never stops the others
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, numWorkers())
+	err = walkWorkloads(ctx, cfg, client, func(wl *Workload) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// errors are already recorded as failed
+			_ = m.processWorkload(ctx, wl)
+		}()
+		return nil
+	})
+	wg.Wait()
+	// failed list calls are counted as failures as well
+	err = m.report.addListErrors(err)
 
-		for _, st := range stList.Items {
-			scopeLog := buildLogger("statefulset", st.Name)
-			// check annotations exists
-			if st.Annotations == nil {
-				continue
-			}
-			// check enabled
-			if enabled, _ := strconv.ParseBool(st.Annotations[AnnotationLogtubeAutoMappingEnabled]); !enabled {
-				continue
-			}
-			// check status.replicas
-			if st.Status.Replicas == 0 {
-				scopeLog("status.replicas == 0")
-				continue
-			}
-			wp := newWorkloadPatch(st.Namespace, st.Name)
-			if err = wp.updateVolumeMounts(cfg, client, st.Spec.Selector.MatchLabels); err != nil {
-				scopeLog("failed to update volume mounts: " + err.Error())
-				err = nil
-				continue
-			}
-			var patch []byte
-			if patch, err = wp.jsonMarshal(); err != nil {
-				return
-			}
-			// execute patch
-			if !optDryRun {
-				if _, err = client.AppsV1().StatefulSets(st.Namespace).Patch(context.Background(), st.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
-					return
-				}
-			}
-			scopeLog("patched")
+	m.saveCache(ctx)
+	if optOutput == OutputJSON {
+		if pErr := m.report.PrintJSON(os.Stdout); pErr != nil && err == nil {
+			err = pErr
+		}
+	} else {
+		m.report.Print()
+	}
+	if n := m.report.count(ResultInvalid); n > 0 && err == nil {
+		err = fmt.Errorf("%d workloads rejected by server-side dry run", n)
+	}
+	if n := m.report.count(ResultFailed); n > optMaxFailures {
+		if err == nil {
+			err = fmt.Errorf("%d failures, exceeding --max-failures %d", n, optMaxFailures)
 		}
+	} else if n > 0 {
+		log.Printf("%d failures, tolerated by --max-failures %d", n, optMaxFailures)
 	}
+	return
+}
+
+func main() {
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Ltime | log.Lmsgprefix)
+
+	cmd, args := resolveCommand(os.Args)
+	if cmd == nil {
+		printUsage(os.Stdout)
+		return
+	}
+
+	var err error
+	defer exit(&err)
+
+	fs := cmd.flagSet()
+	// flag set is created with ExitOnError
+	_ = fs.Parse(args)
+
+	if optDryRun {
+		log.SetPrefix("(dry) ")
+	} else if optValidate {
+		log.SetPrefix("(validate) ")
+	}
+
+	if optOutput, err = outputFormat(); err != nil {
+		return
+	}
+	// keep stdout for the JSON document
+	if optOutput == OutputJSON {
+		log.SetOutput(os.Stderr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-chSig
+		log.Println("signal caught:", sig.String())
+		cancel()
+	}()
+
+	err = cmd.run(ctx)
 }
@@ -1,7 +1,1544 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestScript(t *testing.T) {
-	t.Log(buildLogPathCheckScript())
+	t.Log(buildEnvCheckScript())
+	t.Log(buildMarkFileCheckScript())
+}
+
+func buildTestDeployment(name, logPath string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: map[string]string{AnnotationLogtubeAutoMappingEnabled: "true"}},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: logPath}}},
+		}}}},
+	}
+}
+
+func buildTestPod(ownerKind, ownerName string, ready bool) *corev1.Pod {
+	isController := true
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            ownerName + "-x1",
+			Labels:          map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: "abc"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: ownerKind, Name: ownerName, Controller: &isController}},
+		},
+		Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}},
+	}
+}
+
+// newTestController creates a controller serving deployments from a lister, requests sent to API server are recorded
+func newTestController(t *testing.T, dps ...*appsv1.Deployment) (c *Controller, requests *[]string) {
+	requests = &[]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.Method+" "+r.URL.Path)
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"apiVersion":"apps/v1","kind":"Deployment"}`))
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, dp := range dps {
+		if err = indexer.Add(dp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c = &Controller{
+		client:   client,
+		mapper:   &Mapper{client: client, chain: []Discoverer{specEnvDiscoverer{}}, report: &Report{}},
+		dpLister: appslisters.NewDeploymentLister(indexer),
+		queue:    workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	t.Cleanup(c.queue.ShutDown)
+	return
+}
+
+func TestPodOwnerKey(t *testing.T) {
+	for _, item := range []struct {
+		pod *corev1.Pod
+		key string
+	}{
+		{buildTestPod("ReplicaSet", "demo-abc", true), buildWorkloadKey(KindDeployment, "default", "demo")},
+		{buildTestPod("ReplicaSet", "demo-xyz", true), ""},
+		{buildTestPod("StatefulSet", "demo", true), buildWorkloadKey(KindStatefulSet, "default", "demo")},
+		{buildTestPod("DaemonSet", "demo", true), buildWorkloadKey(KindDaemonSet, "default", "demo")},
+		{buildTestPod("Job", "backup-29000000", true), buildWorkloadKey(KindCronJob, "default", "backup")},
+		{buildTestPod("Job", "migrate", true), ""},
+		{&corev1.Pod{}, ""},
+	} {
+		if key := podOwnerKey(item.pod); key != item.key {
+			t.Fatalf("unexpected owner of %+v: %s", item.pod.OwnerReferences, key)
+		}
+	}
+}
+
+func TestControllerEventFilter(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	c, _ := newTestController(t)
+	handler := c.buildWorkloadHandler(KindDeployment)
+	handler.OnAdd(buildTestDeployment("demo", "/work/logs"))
+	disabled := buildTestDeployment("disabled", "/work/logs")
+	disabled.Annotations = nil
+	handler.OnAdd(disabled)
+	if c.queue.Len() != 1 {
+		t.Fatalf("unexpected queue length: %d", c.queue.Len())
+	}
+	// opted out, but still mapped
+	wp := newWorkloadPatch("default", "disabled")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	disabled.Spec.Template.Spec = *wp.mergeInto(&disabled.Spec.Template.Spec)
+	handler.OnUpdate(nil, disabled)
+	if c.queue.Len() != 2 {
+		t.Fatalf("unexpected queue length: %d", c.queue.Len())
+	}
+
+	c, _ = newTestController(t)
+	c.handlePod(nil, buildTestPod("ReplicaSet", "demo-abc", false))
+	if c.queue.Len() != 0 {
+		t.Fatal("pod not ready enqueued")
+	}
+	c.handlePod(buildTestPod("ReplicaSet", "demo-abc", false), buildTestPod("ReplicaSet", "demo-abc", true))
+	if item, _ := c.queue.Get(); item != buildWorkloadKey(KindDeployment, "default", "demo") {
+		t.Fatalf("unexpected item: %v", item)
+	} else {
+		c.queue.Done(item)
+	}
+	// already ready before
+	c.handlePod(buildTestPod("ReplicaSet", "demo-abc", true), buildTestPod("ReplicaSet", "demo-abc", true))
+	if c.queue.Len() != 0 {
+		t.Fatal("pod already ready enqueued")
+	}
+}
+
+func TestControllerReconcile(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	mapped := buildTestDeployment("mapped", "/work/logs")
+	wp := newWorkloadPatch("default", "mapped")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	mapped.Spec.Template.Spec = *wp.mergeInto(&mapped.Spec.Template.Spec)
+	// log path changed after mapped
+	changed := mapped.DeepCopy()
+	changed.Name = "changed"
+	changed.Spec.Template.Spec.Containers[0].Env[0].Value = "/data/logs"
+
+	c, requests := newTestController(t, buildTestDeployment("demo", "/work/logs"), mapped, changed)
+	for _, name := range []string{"demo", "mapped", "changed", "missing"} {
+		if err := c.reconcile(context.Background(), buildWorkloadKey(KindDeployment, "default", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*requests) != 2 ||
+		(*requests)[0] != "PATCH /apis/apps/v1/namespaces/default/deployments/demo" ||
+		(*requests)[1] != "PATCH /apis/apps/v1/namespaces/default/deployments/changed" {
+		t.Fatalf("unexpected requests: %v", *requests)
+	}
+	report := c.mapper.report
+	if report.count(ResultCreated) != 1 || report.count(ResultUnchanged) != 1 || report.count(ResultUpdated) != 1 {
+		t.Fatalf("unexpected report: %+v", report.entries)
+	}
+}
+
+// reviewMutate sends an admission review of the object to the webhook handler
+func reviewMutate(t *testing.T, kind string, obj interface{}) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+		UID:       types.UID("uid-" + kind),
+		Kind:      metav1.GroupVersionKind{Kind: kind},
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	handleMutate(rw, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+	var review admissionv1.AdmissionReview
+	if err = json.Unmarshal(rw.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	res := review.Response
+	if res == nil || res.UID != types.UID("uid-"+kind) || !res.Allowed {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+	return res
+}
+
+// reviewPatch returns JSON patch operations of an admission response
+func reviewPatch(t *testing.T, res *admissionv1.AdmissionResponse) (ops []JSONPatchOperation) {
+	if res.PatchType == nil || *res.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Fatalf("unexpected patch type: %v", res.PatchType)
+	}
+	if err := json.Unmarshal(res.Patch, &ops); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestHandleMutate(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	enabled := map[string]string{AnnotationLogtubeAutoMappingEnabled: "true"}
+	spec := corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "app", Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: "/work/logs"}}},
+	}}
+	isController := true
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName:    "backup-29000000-",
+			Annotations:     enabled,
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Job", Name: "backup-29000000", Controller: &isController}},
+		},
+		Spec: spec,
+	}
+	res := reviewMutate(t, "Pod", pod)
+	ops := reviewPatch(t, res)
+	if len(ops) != 2 || ops[0].Path != "/spec/volumes" || ops[1].Path != "/spec/containers/0/volumeMounts" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+	// host path of pods created by cronjob stays the same across runs
+	if !strings.Contains(string(res.Patch), `"path":"/data/logtube-logs/default-backup/app"`) {
+		t.Fatalf("unexpected patch: %s", res.Patch)
+	}
+
+	dp := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo", Annotations: enabled}}
+	dp.Spec.Template.Spec = spec
+	if ops = reviewPatch(t, reviewMutate(t, "Deployment", dp)); len(ops) != 2 || ops[0].Path != "/spec/template/spec/volumes" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+
+	st := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "demo", Annotations: enabled}}
+	st.Spec.Template.Spec = spec
+	if ops = reviewPatch(t, reviewMutate(t, "StatefulSet", st)); len(ops) != 2 || ops[1].Path != "/spec/template/spec/containers/0/volumeMounts" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+
+	cj := &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "backup", Annotations: enabled}}
+	cj.Spec.JobTemplate.Spec.Template.Spec = spec
+	if ops = reviewPatch(t, reviewMutate(t, "CronJob", cj)); len(ops) != 2 || ops[0].Path != "/spec/jobTemplate/spec/template/spec/volumes" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+
+	// opted out
+	dp.Annotations = nil
+	if res := reviewMutate(t, "Deployment", dp); res.Patch != nil || res.PatchType != nil {
+		t.Fatalf("unexpected patch: %s", res.Patch)
+	}
+
+	// already mapped
+	wp := newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	dp.Annotations = enabled
+	dp.Spec.Template.Spec.Volumes = wp.Spec.Template.Spec.Volumes
+	dp.Spec.Template.Spec.Containers = wp.Spec.Template.Spec.Containers
+	dp.Spec.Template.Spec.Containers[0].Env = spec.Containers[0].Env
+	if res := reviewMutate(t, "Deployment", dp); res.Patch != nil || res.PatchType != nil {
+		t.Fatalf("unexpected patch: %s", res.Patch)
+	}
+}
+
+func TestWorkloadPatchJSONPatch(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "sidecar"},
+			{Name: "app", Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: "/work/logs"}}},
+		},
+	}
+	results, err := (&Discovery{
+		Chain: []Discoverer{specEnvDiscoverer{}, annotationDiscoverer{}},
+		Spec:  spec,
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp := newWorkloadPatch("default", "demo")
+	wp.applyDiscoveryResults(results)
+	ops := wp.jsonPatch("/spec", spec)
+	if len(ops) != 2 {
+		t.Fatalf("expect 2 operations, got %d", len(ops))
+	}
+	if ops[0].Path != "/spec/volumes" || ops[1].Path != "/spec/containers/1/volumeMounts" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+	// already mapped
+	spec.Volumes = wp.Spec.Template.Spec.Volumes
+	spec.Containers[1].VolumeMounts = wp.Spec.Template.Spec.Containers[0].VolumeMounts
+	if ops = wp.jsonPatch("/spec", spec); len(ops) != 0 {
+		t.Fatalf("expect no operations, got %+v", ops)
+	}
+}
+
+func TestWorkloadPatchCompare(t *testing.T) {
+	hostPath := optHostPath
+	t.Cleanup(func() { optHostPath = hostPath })
+	optHostPath = "/data/logtube-logs"
+	spec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}
+	wp := newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	if state := wp.compare(spec); state != ResultCreated {
+		t.Fatalf("unexpected state: %s", state)
+	}
+
+	spec.Volumes = append([]corev1.Volume{}, wp.Spec.Template.Spec.Volumes...)
+	spec.Containers[0].VolumeMounts = append([]corev1.VolumeMount{}, wp.Spec.Template.Spec.Containers[0].VolumeMounts...)
+	if state := wp.compare(spec); state != ResultUnchanged {
+		t.Fatalf("unexpected state: %s", state)
+	}
+
+	// host path changed
+	optHostPath = "/var/logtube-logs"
+	wp = newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	if state := wp.compare(spec); state != ResultUpdated {
+		t.Fatalf("unexpected state: %s", state)
+	}
+	ops := wp.jsonPatch("/spec", spec)
+	if len(ops) != 1 || ops[0].Op != "replace" || ops[0].Path != "/spec/volumes/0" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+
+	// mounted with sub path before
+	spec.Containers[0].VolumeMounts[0].SubPath = "work-logs"
+	if ops = wp.jsonPatch("/spec", spec); len(ops) != 2 || ops[1].Path != "/spec/containers/0/volumeMounts/0" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+}
+
+func TestBuildSpecDiff(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	spec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "demo/app"}}}
+	wp := newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	after := wp.mergeInto(spec)
+	if len(spec.Volumes) != 0 || len(spec.Containers[0].VolumeMounts) != 0 {
+		t.Fatal("original spec modified")
+	}
+	if wp.compare(after) != ResultUnchanged {
+		t.Fatal("expect merged spec mapped")
+	}
+	diff, err := buildSpecDiff(spec, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"+  - mountPath: /work/logs",
+		"+    name: vol-logtube-auto-mapping-app",
+		"+    path: /data/logtube-logs/default-demo/app",
+	} {
+		if !strings.Contains(diff, line+"\n") {
+			t.Fatalf("missing line %q in diff:\n%s", line, diff)
+		}
+	}
+}
+
+func TestParseCustomResources(t *testing.T) {
+	crs, err := parseCustomResources("argoproj.io/v1alpha1/rollouts:spec.template:spec.selector; apps.openshift.io/v1/deploymentconfigs:spec.template:spec.selector:status.availableReplicas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crs) != 2 {
+		t.Fatalf("expect 2 custom resources, got %d", len(crs))
+	}
+	if crs[0].Kind() != "rollouts.argoproj.io" || strings.Join(crs[0].ReplicasPath, ".") != "status.replicas" {
+		t.Fatalf("unexpected custom resource: %+v", crs[0])
+	}
+	if strings.Join(crs[1].ReplicasPath, ".") != "status.availableReplicas" {
+		t.Fatalf("unexpected custom resource: %+v", crs[1])
+	}
+	if _, err = parseCustomResources("rollouts:spec.template"); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	cmd, args := resolveCommand([]string{"/auto-logtube-mapping", "status", "--namespace", "default"})
+	if cmd == nil || cmd.Name != "status" || len(args) != 2 {
+		t.Fatalf("unexpected command: %v %v", cmd, args)
+	}
+	if cmd, _ = resolveCommand([]string{"/migrate-logtube-mapping"}); cmd == nil || cmd.Name != "migrate" {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+	mode, dryRun := optMode, optDryRun
+	t.Cleanup(func() { optMode, optDryRun = mode, dryRun })
+	optMode, optDryRun = "", true
+	if cmd, args = resolveCommand([]string{"/auto-logtube-mapping", "--kubeconfig", "x"}); cmd == nil || cmd.Name != "plan" || len(args) != 2 {
+		t.Fatalf("unexpected command: %v %v", cmd, args)
+	}
+	optDryRun = false
+	if cmd, _ = resolveCommand([]string{"/auto-logtube-mapping", "--help"}); cmd != nil {
+		t.Fatalf("unexpected command: %v", cmd)
+	}
+}
+
+func TestNewDiscoveryChain(t *testing.T) {
+	optDiscoverers, optDiscoveryScripts = "", "jar=ls /app\nwar=ls /webapps"
+	chain, err := newDiscoveryChain(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range chain {
+		names = append(names, d.Name())
+	}
+	if strings.Join(names, ",") != "spec-env,annotation,exec-env,exec-marker,script:jar,script:war" {
+		t.Fatalf("unexpected chain: %v", names)
+	}
+
+	optDiscoverers = "annotation, spec-env"
+	if chain, err = newDiscoveryChain(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	results, err := (&Discovery{
+		Chain:       chain,
+		Annotations: map[string]string{AnnotationLogtubeAutoMappingPath: "/var/log/app"},
+		Spec: &corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: "/work/logs"}}},
+			},
+		},
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].LogPaths[0] != "/var/log/app" || results[0].Source != DiscovererAnnotation {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	for _, opt := range []string{"exec-env,script:missing", "unknown"} {
+		optDiscoverers = opt
+		if _, err = newDiscoveryChain(nil, nil); err == nil {
+			t.Fatalf("expect error for %s", opt)
+		}
+	}
+	optDiscoverers, optDiscoveryScripts = "", ""
+}
+
+func TestWorkloadPatchMultipleContainers(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "nginx", Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: "/var/log/nginx"}}},
+			{Name: "app", Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: "/work/logs"}}},
+			{Name: "agent"},
+		},
+	}
+	results, err := (&Discovery{Chain: []Discoverer{specEnvDiscoverer{}}, Spec: spec}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp := newWorkloadPatch("default", "demo")
+	wp.applyDiscoveryResults(results)
+	volumes := wp.Spec.Template.Spec.Volumes
+	if len(volumes) != 2 {
+		t.Fatalf("expect 2 volumes, got %d", len(volumes))
+	}
+	if volumes[0].Name != "vol-logtube-auto-mapping-nginx" || volumes[0].HostPath.Path != "/data/logtube-logs/default-demo/nginx" {
+		t.Fatalf("unexpected volume: %+v", volumes[0])
+	}
+	if volumes[1].Name != "vol-logtube-auto-mapping-app" || volumes[1].HostPath.Path != "/data/logtube-logs/default-demo/app" {
+		t.Fatalf("unexpected volume: %+v", volumes[1])
+	}
+	if !isAutoMappingVolume(volumes[0].Name) || !isAutoMappingVolume(VolumeNameLogtubeAutoMapping) || isAutoMappingVolume("vol-logtube-auto-mappings") {
+		t.Fatal("unexpected isAutoMappingVolume")
+	}
+
+	long := strings.Repeat("a", 63)
+	name := buildVolumeName(long)
+	if len(name) > 63 || name == buildVolumeName(long[:62]+"b") {
+		t.Fatalf("unexpected volume name: %s", name)
+	}
+}
+
+func TestWorkloadPatchLegacyVolume(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	hostPathType := corev1.HostPathDirectoryOrCreate
+	spec := &corev1.PodSpec{
+		Volumes: []corev1.Volume{
+			{Name: "config"},
+			{Name: VolumeNameLogtubeAutoMapping, VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{
+				Path: "/data/logtube-logs/default-demo",
+				Type: &hostPathType,
+			}}},
+		},
+		Containers: []corev1.Container{{Name: "app", VolumeMounts: []corev1.VolumeMount{
+			{Name: "config", MountPath: "/config"},
+			{Name: VolumeNameLogtubeAutoMapping, MountPath: "/work/logs"},
+		}}},
+	}
+	wp := newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	if state := wp.compare(spec); state != ResultUpdated {
+		t.Fatalf("unexpected state: %s", state)
+	}
+	ops := wp.jsonPatch("/spec", spec)
+	if len(ops) != 3 ||
+		ops[0].Op != "add" || ops[0].Path != "/spec/volumes/-" ||
+		ops[1].Op != "replace" || ops[1].Path != "/spec/containers/0/volumeMounts/1" ||
+		ops[2].Op != "remove" || ops[2].Path != "/spec/volumes/1" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+	after := wp.mergeInto(spec)
+	if len(after.Volumes) != 2 || after.Volumes[0].Name != "config" || after.Volumes[1].Name != buildVolumeName("app") {
+		t.Fatalf("unexpected volumes: %+v", after.Volumes)
+	}
+	if state := wp.compare(after); state != ResultUnchanged {
+		t.Fatalf("unexpected state after merge: %s", state)
+	}
+
+	// still referenced by a container failed to discover this time
+	spec.Containers = append(spec.Containers, corev1.Container{Name: "sidecar", VolumeMounts: []corev1.VolumeMount{
+		{Name: VolumeNameLogtubeAutoMapping, MountPath: "/var/log"},
+	}})
+	wp.applyDiscoveryResults([]DiscoveryResult{{Container: "sidecar", Err: errors.New("exec timeout")}})
+	for _, op := range wp.jsonPatch("/spec", spec) {
+		if op.Op == "remove" {
+			t.Fatalf("unexpected operation: %+v", op)
+		}
+	}
+}
+
+func TestWorkloadPatchStale(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	wp := newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs", "/work/gc-logs"})
+	wp.addVolumeMount("sidecar", []string{"/var/log/nginx"})
+	spec := wp.mergeInto(&corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "sidecar"}}})
+
+	// /work/gc-logs no longer declared, /work/logs is mounted at the volume root
+	wp = newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	wp.addVolumeMount("sidecar", []string{"/var/log/nginx"})
+	if state := wp.compare(spec); state != ResultUpdated {
+		t.Fatalf("unexpected state: %s", state)
+	}
+	ops := wp.jsonPatch("/spec", spec)
+	if len(ops) != 2 ||
+		ops[0].Op != "replace" || ops[0].Path != "/spec/containers/0/volumeMounts/0" ||
+		ops[1].Op != "remove" || ops[1].Path != "/spec/containers/0/volumeMounts/1" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+	after := wp.mergeInto(spec)
+	if mounts := after.Containers[0].VolumeMounts; len(mounts) != 1 || mounts[0].MountPath != "/work/logs" || mounts[0].SubPath != "" {
+		t.Fatalf("unexpected volume mounts: %+v", mounts)
+	}
+	if state := wp.compare(after); state != ResultUnchanged {
+		t.Fatalf("unexpected state after merge: %s", state)
+	}
+
+	// sidecar no longer declares a log path, its volume and volume mount are removed
+	wp = newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs", "/work/gc-logs"})
+	if state := wp.compare(spec); state != ResultUpdated {
+		t.Fatalf("unexpected state: %s", state)
+	}
+	ops = wp.jsonPatch("/spec", spec)
+	if len(ops) != 2 ||
+		ops[0].Op != "remove" || ops[0].Path != "/spec/containers/1/volumeMounts/0" ||
+		ops[1].Op != "remove" || ops[1].Path != "/spec/volumes/1" {
+		t.Fatalf("unexpected operations: %+v", ops)
+	}
+	after = wp.mergeInto(spec)
+	if len(after.Volumes) != 1 || after.Volumes[0].Name != buildVolumeName("app") || len(after.Containers[1].VolumeMounts) != 0 {
+		t.Fatalf("unexpected spec: %+v", after)
+	}
+	if state := wp.compare(after); state != ResultUnchanged {
+		t.Fatalf("unexpected state after merge: %s", state)
+	}
+}
+
+type testEnvSource struct {
+	configMaps map[string]map[string]string
+	secrets    map[string]map[string][]byte
+}
+
+func (s testEnvSource) configMap(ctx context.Context, namespace, name string) (map[string]string, error) {
+	if data, ok := s.configMaps[name]; ok {
+		return data, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+}
+
+func (s testEnvSource) secret(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	if data, ok := s.secrets[name]; ok {
+		return data, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+}
+
+func TestResolveEnvFromSpec(t *testing.T) {
+	optional := true
+	src := testEnvSource{
+		configMaps: map[string]map[string]string{
+			"app":    {EnvLogtubeAutoMapping: "/work/logs", "LOG_DIR": "/var/log/app"},
+			"common": {EnvLogtubeAutoMapping: "/common/logs"},
+		},
+		secrets: map[string]map[string][]byte{
+			"secret": {"K8S_AUTO_MAPPING": []byte("/secret/logs")},
+		},
+	}
+	cases := []struct {
+		container corev1.Container
+		expected  string
+		err       bool
+	}{
+		{corev1.Container{Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: "/literal"}}}, "/literal", false},
+		{corev1.Container{Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}, Key: "LOG_DIR"},
+		}}}}, "/var/log/app", false},
+		{corev1.Container{EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "common"}}},
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}},
+		}}, "/work/logs", false},
+		{corev1.Container{
+			Env:     []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: "/override"}},
+			EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}},
+		}, "/override", false},
+		{corev1.Container{EnvFrom: []corev1.EnvFromSource{
+			{Prefix: "LOGTUBE_", SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "secret"}}},
+		}}, "/secret/logs", false},
+		{corev1.Container{EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Optional: &optional}},
+		}}, "", false},
+		{corev1.Container{EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}}},
+		}}, "", true},
+	}
+	for i, c := range cases {
+		value, err := resolveEnvFromSpec(context.Background(), src, "default", &c.container, EnvLogtubeAutoMapping)
+		if (err != nil) != c.err || value != c.expected {
+			t.Fatalf("case %d: unexpected %q, %v", i, value, err)
+		}
+	}
+}
+
+func TestAnnotationDiscoverer(t *testing.T) {
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "app"}, {Name: "nginx"}, {Name: "agent"}},
+	}
+	results, err := (&Discovery{
+		Chain: []Discoverer{annotationDiscoverer{}},
+		Annotations: map[string]string{
+			AnnotationLogtubeAutoMappingPath + ".app":   "/work/logs",
+			AnnotationLogtubeAutoMappingPath + ".nginx": "/var/log/nginx",
+		},
+		Spec: spec,
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].LogPaths[0] != "/work/logs" || results[1].LogPaths[0] != "/var/log/nginx" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	// plain annotation is ambiguous with multiple containers
+	if _, err = (&Discovery{
+		Chain:       []Discoverer{annotationDiscoverer{}},
+		Annotations: map[string]string{AnnotationLogtubeAutoMappingPath: "/work/logs"},
+		Spec:        spec,
+	}).Run(context.Background()); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	cases := map[string]string{
+		"nginx":                             "registry-1.docker.io/library/nginx:latest",
+		"guoyk/auto-logtube-mapping:v1":     "registry-1.docker.io/guoyk/auto-logtube-mapping:v1",
+		"docker.io/library/nginx@sha256:ab": "registry-1.docker.io/library/nginx@sha256:ab",
+		"localhost:5000/app":                "localhost:5000/app:latest",
+		"registry.example.com/team/app:1.0": "registry.example.com/team/app:1.0",
+	}
+	for image, expected := range cases {
+		ref, err := parseImageReference(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.String() != expected {
+			t.Fatalf("%s: expect %s, got %s", image, expected, ref.String())
+		}
+	}
+}
+
+func TestRegistryDiscoverer(t *testing.T) {
+	config, _ := json.Marshal(map[string]interface{}{
+		"config": map[string]interface{}{
+			"Env":    []string{"PATH=/usr/bin", EnvLogtubeAutoMapping + "=/work/logs"},
+			"Labels": map[string]string{LabelLogtubeAutoMappingPath: "/label/logs"},
+		},
+	})
+	configSum := sha256.Sum256(config)
+	configDigest := "sha256:" + hex.EncodeToString(configSum[:])
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if u, p, _ := r.BasicAuth(); u != "robot" || p != "secret" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = rw.Write([]byte(`{"token":"test-token"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:team/app:pull"`)
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/sha256:index":
+			_, _ = rw.Write([]byte(`{"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[
+				{"digest":"sha256:arm64","platform":{"os":"linux","architecture":"arm64"}},
+				{"digest":"sha256:amd64","platform":{"os":"linux","architecture":"amd64"}}
+			]}`))
+		case "/v2/team/app/manifests/sha256:amd64":
+			_, _ = rw.Write([]byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"` + configDigest + `"}}`))
+		case "/v2/team/app/blobs/" + configDigest:
+			_, _ = rw.Write(config)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	optRegistryInsecure = host
+	defer func() { optRegistryInsecure = "" }()
+
+	dockerConfig, _ := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			host: map[string]string{"username": "robot", "password": "secret"},
+		},
+	})
+	d := &registryDiscoverer{
+		src: testEnvSource{secrets: map[string]map[string][]byte{
+			"pull": {corev1.DockerConfigJsonKey: dockerConfig},
+		}},
+		client: server.Client(),
+	}
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers:       []corev1.Container{{Name: "app", Image: host + "/team/app:1.0"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "pull"}},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", ImageID: "docker-pullable://" + host + "/team/app@sha256:index"}},
+		},
+	}
+	logPath, err := d.Discover(context.Background(), &DiscoveryTarget{Container: &pod.Spec.Containers[0], Pod: pod})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logPath != "/work/logs" {
+		t.Fatalf("unexpected log path: %s", logPath)
+	}
+}
+
+func TestWorkloadPatchMultipleLogPaths(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	if paths := splitLogPaths("/work/logs:/work/gc-logs,/work/logs\n/var/log/Access Logs\n"); strings.Join(paths, "|") != "/work/logs|/work/gc-logs|/var/log/Access Logs" {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+	wp := newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs", "/work/gc-logs", "/work-logs", "/var/log/Access Logs"})
+	if len(wp.Spec.Template.Spec.Volumes) != 1 {
+		t.Fatalf("expect 1 volume, got %d", len(wp.Spec.Template.Spec.Volumes))
+	}
+	var subPaths []string
+	for _, vm := range wp.Spec.Template.Spec.Containers[0].VolumeMounts {
+		subPaths = append(subPaths, vm.SubPath)
+	}
+	if strings.Join(subPaths, ",") != "work-logs,work-gc-logs,work-logs-2,var-log-access-logs" {
+		t.Fatalf("unexpected sub paths: %v", subPaths)
+	}
+	// single log path is mounted directly
+	wp = newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	if vm := wp.Spec.Template.Spec.Containers[0].VolumeMounts[0]; vm.SubPath != "" {
+		t.Fatalf("unexpected sub path: %s", vm.SubPath)
+	}
+}
+
+func TestSelectPod(t *testing.T) {
+	now := metav1.Now()
+	ready := []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	buildPod := func(name, hash string, phase corev1.PodPhase, conditions []corev1.PodCondition) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"pod-template-hash": hash}},
+			Status:     corev1.PodStatus{Phase: phase, Conditions: conditions},
+		}
+	}
+	terminating := buildPod("terminating", "new", corev1.PodRunning, ready)
+	terminating.DeletionTimestamp = &now
+	pods := []corev1.Pod{
+		terminating,
+		buildPod("pending", "new", corev1.PodPending, nil),
+		buildPod("old", "old", corev1.PodRunning, ready),
+		buildPod("starting", "new", corev1.PodRunning, nil),
+		buildPod("current", "new", corev1.PodRunning, ready),
+	}
+	selected, reason, err := selectPods(pods, "pod-template-hash", "new", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].Name != "current" {
+		t.Fatalf("unexpected pods: %v", selected)
+	}
+	t.Log(reason)
+
+	// revision unknown
+	if selected, _, err = selectPods(pods, "", "", 1); err != nil || selected[0].Name != "old" {
+		t.Fatalf("unexpected pods: %v, %v", selected, err)
+	}
+	if selected, _, err = selectPods(pods, "", "", 0); err != nil || len(selected) != 2 {
+		t.Fatalf("unexpected pods: %v, %v", selected, err)
+	}
+
+	if _, _, err = selectPods(pods[:4], "pod-template-hash", "new", 1); err == nil {
+		t.Fatal("expect error")
+	} else if err.Error() != "no eligible pod in 4 pods: 1 terminating, 1 not running, 1 not ready, 1 from previous revisions" {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+}
+
+type testPodDiscoverer map[string]string
+
+func (d testPodDiscoverer) Name() string {
+	return "test"
+}
+
+func (d testPodDiscoverer) RequiresPod() bool {
+	return true
+}
+
+func (d testPodDiscoverer) Discover(ctx context.Context, t *DiscoveryTarget) (string, error) {
+	return d[t.Pod.Name], nil
+}
+
+func TestDiscoveryConflict(t *testing.T) {
+	spec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}
+	pods := []*corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "app-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "app-2"}},
+	}
+	d := &Discovery{
+		Chain: []Discoverer{testPodDiscoverer{"app-1": "/work/logs", "app-2": "/work/logs"}},
+		Spec:  spec,
+		Pods: func(ctx context.Context) ([]*corev1.Pod, error) {
+			return pods, nil
+		},
+	}
+	results, err := d.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].LogPaths[0] != "/work/logs" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	d.Chain = []Discoverer{testPodDiscoverer{"app-1": "/work/logs", "app-2": "/data/logs"}}
+	if _, err = d.Run(context.Background()); err == nil {
+		t.Fatal("expect conflict")
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("unexpected error: %s", err.Error())
+	} else {
+		t.Log(err.Error())
+	}
+}
+
+type testCache map[string]CacheEntry
+
+func (c testCache) Get(key string) (entry CacheEntry, ok bool) {
+	entry, ok = c[key]
+	return
+}
+
+func (c testCache) Set(key string, entry CacheEntry) {
+	c[key] = entry
+}
+
+func (c testCache) Save(ctx context.Context) error {
+	return nil
+}
+
+func TestPruneCacheData(t *testing.T) {
+	data := map[string]string{"a.app": "{}", "b.app": "{}", "c.app": "{}", "d.app": "{}"}
+	used := map[string]bool{"a.app": true, "d.app": true}
+	if data = pruneCacheData(data, used, 4); len(data) != 4 {
+		t.Fatalf("unexpected pruned data: %v", data)
+	}
+	data = pruneCacheData(data, used, 3)
+	if len(data) != 3 || data["b.app"] != "" || data["a.app"] == "" || data["d.app"] == "" {
+		t.Fatalf("unexpected pruned data: %v", data)
+	}
+	// used entries are kept even beyond max
+	data = pruneCacheData(data, used, 1)
+	if len(data) != 2 || data["a.app"] == "" || data["d.app"] == "" {
+		t.Fatalf("unexpected pruned data: %v", data)
+	}
+
+	c := &configMapCache{entries: map[string]CacheEntry{"a.app": {LogPaths: []string{"/work/logs"}}}, dirty: map[string]bool{}, used: map[string]bool{}}
+	c.Get("a.app")
+	c.Get("b.app")
+	c.Set("c.app", CacheEntry{LogPaths: []string{"/work/logs"}})
+	if len(c.used) != 2 || !c.used["a.app"] || !c.used["c.app"] {
+		t.Fatalf("unexpected used keys: %v", c.used)
+	}
+}
+
+func TestConfigMapCacheForbidden(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusForbidden)
+		_, _ = rw.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Forbidden","code":403}`))
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConfigMapCache(context.Background(), client, "default/cache")
+	c.Set("sha256-aaa.app", CacheEntry{LogPaths: []string{"/work/logs"}})
+	if entry, ok := c.Get("sha256-aaa.app"); !ok || entry.LogPaths[0] != "/work/logs" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	if err = c.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0] != "GET /api/v1/namespaces/default/configmaps/cache" {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+}
+
+func TestDiscoveryCache(t *testing.T) {
+	buildPod := func(name, imageID string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", ImageID: imageID},
+			}},
+		}
+	}
+	pods := []*corev1.Pod{
+		buildPod("app-1", "docker-pullable://demo/app@sha256:aaa"),
+	}
+	cache := testCache{}
+	d := &Discovery{
+		Chain: []Discoverer{testPodDiscoverer{"app-1": "/work/logs", "app-2": "/data/logs"}},
+		Spec:  &corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		Pods: func(ctx context.Context) ([]*corev1.Pod, error) {
+			return pods, nil
+		},
+		Cache: cache,
+	}
+	results, err := d.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Source != "test" {
+		t.Fatalf("unexpected source: %s", results[0].Source)
+	}
+	if entry, ok := cache["sha256-aaa.app"]; !ok || entry.LogPaths[0] != "/work/logs" {
+		t.Fatalf("unexpected cache: %+v", cache)
+	}
+
+	// same digest, pod not probed
+	pods = []*corev1.Pod{buildPod("app-2", "docker-pullable://demo/app@sha256:aaa")}
+	if results, err = d.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Source != "cache (test)" || results[0].LogPaths[0] != "/work/logs" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	// digest changed, pod probed again
+	pods = []*corev1.Pod{buildPod("app-2", "docker-pullable://demo/app@sha256:bbb")}
+	if results, err = d.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Source != "test" || results[0].LogPaths[0] != "/data/logs" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	if digest := containerImageDigest(buildPod("app-1", "docker://sha256:ccc"), "app"); digest != "sha256:ccc" {
+		t.Fatalf("unexpected digest: %s", digest)
+	}
+	if digest := containerImageDigest(buildPod("app-1", ""), "app"); digest != "" {
+		t.Fatalf("unexpected digest: %s", digest)
+	}
+}
+
+func TestBuildSelector(t *testing.T) {
+	s, err := buildSelector(&metav1.LabelSelector{
+		MatchLabels: map[string]string{"app": "demo"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"web", "api"}},
+			{Key: "canary", Operator: metav1.LabelSelectorOpDoesNotExist},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "app=demo,!canary,tier in (api,web)" {
+		t.Fatalf("unexpected selector: %s", s)
+	}
+	if _, err = buildSelector(nil); err == nil {
+		t.Fatal("expect error for nil selector")
+	}
+	if _, err = buildSelector(&metav1.LabelSelector{}); err == nil {
+		t.Fatal("expect error for empty selector")
+	}
+}
+
+func TestFilterOwnedPods(t *testing.T) {
+	controller := true
+	buildPod := func(name string, owner types.UID) corev1.Pod {
+		return corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			OwnerReferences: []metav1.OwnerReference{{UID: owner, Controller: &controller}},
+		}}
+	}
+	pods := []corev1.Pod{buildPod("mine", "rs-1"), buildPod("other", "rs-2"), {ObjectMeta: metav1.ObjectMeta{Name: "orphan"}}}
+	owned := filterOwnedPods(pods, map[types.UID]bool{"dp": true, "rs-1": true})
+	if len(owned) != 1 || owned[0].Name != "mine" {
+		t.Fatalf("unexpected pods: %v", owned)
+	}
+	if len(filterOwnedPods(pods, nil)) != 3 {
+		t.Fatal("expect all pods without owners")
+	}
+}
+
+func TestFilterOwnedPodsReplicationController(t *testing.T) {
+	controller := true
+	buildRef := func(uid types.UID) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{UID: uid, Controller: &controller}}
+	}
+	// Pod -> ReplicationController -> DeploymentConfig
+	uids := map[types.UID]bool{"dc": true}
+	addControlledUID(uids, "dc", &corev1.ReplicationController{ObjectMeta: metav1.ObjectMeta{UID: "rc-1", OwnerReferences: buildRef("dc")}})
+	addControlledUID(uids, "dc", &corev1.ReplicationController{ObjectMeta: metav1.ObjectMeta{UID: "rc-2", OwnerReferences: buildRef("other-dc")}})
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "dc-1-abcde", OwnerReferences: buildRef("rc-1")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other-1-abcde", OwnerReferences: buildRef("rc-2")}},
+	}
+	owned := filterOwnedPods(pods, uids)
+	if len(owned) != 1 || owned[0].Name != "dc-1-abcde" {
+		t.Fatalf("unexpected pods: %v", owned)
+	}
+}
+
+func TestNodeLimiter(t *testing.T) {
+	l := newNodeLimiter(1)
+	release, err := l.acquire(context.Background(), "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other nodes are not affected
+	release2, err := l.acquire(context.Background(), "node-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = l.acquire(ctx, "node-1"); err == nil {
+		t.Fatal("expect timeout")
+	}
+	release()
+	if release, err = l.acquire(context.Background(), "node-1"); err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	b := &limitedBuffer{n: 4}
+	_, _ = b.Write([]byte("abc"))
+	_, _ = b.Write([]byte("def"))
+	if b.String() != "abcd" {
+		t.Fatalf("unexpected buffer: %s", b.String())
+	}
+}
+
+type testConnection struct {
+	httpstream.Connection
+	closed bool
+}
+
+func (c *testConnection) Close() error {
+	c.closed = true
+	return nil
+}
+
+type testUpgrader struct {
+	conn *testConnection
+}
+
+func (u testUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	return u.conn, nil
+}
+
+func TestClosingUpgrader(t *testing.T) {
+	conn := &testConnection{}
+	u := &closingUpgrader{Upgrader: testUpgrader{conn: conn}}
+	if _, err := u.NewConnection(nil); err != nil {
+		t.Fatal(err)
+	}
+	u.Close()
+	if !conn.closed {
+		t.Fatal("expect connection closed")
+	}
+
+	// timed out before upgraded
+	conn = &testConnection{}
+	u = &closingUpgrader{Upgrader: testUpgrader{conn: conn}}
+	u.Close()
+	if _, err := u.NewConnection(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.closed {
+		t.Fatal("expect connection closed once created")
+	}
+}
+
+// testBarrierDiscoverer fails unless all pods are probed at the same time
+type testBarrierDiscoverer struct {
+	arrived chan struct{}
+	n       int
+}
+
+func (d *testBarrierDiscoverer) Name() string {
+	return "barrier"
+}
+
+func (d *testBarrierDiscoverer) RequiresPod() bool {
+	return true
+}
+
+func (d *testBarrierDiscoverer) Discover(ctx context.Context, t *DiscoveryTarget) (string, error) {
+	d.arrived <- struct{}{}
+	deadline := time.After(time.Second)
+	for len(d.arrived) < d.n {
+		select {
+		case <-deadline:
+			return "", errors.New("pods are not probed in parallel")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return "/work/logs", nil
+}
+
+func TestDiscoverPodsParallel(t *testing.T) {
+	var pods []*corev1.Pod
+	for _, name := range []string{"app-1", "app-2", "app-3"} {
+		pods = append(pods, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	dc := &testBarrierDiscoverer{arrived: make(chan struct{}, len(pods)), n: len(pods)}
+	target := DiscoveryTarget{Container: &corev1.Container{Name: "app"}}
+	logPaths, err := discoverPods(context.Background(), dc, target, pods, make(chan struct{}, len(pods)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logPaths) != 1 || logPaths[0] != "/work/logs" {
+		t.Fatalf("unexpected log paths: %v", logPaths)
+	}
+}
+
+// testImageDiscoverer records concurrent and total probes, pods of the same image are probed once
+type testImageDiscoverer struct {
+	mu      sync.Mutex
+	running int
+	max     int
+	calls   int
+}
+
+func (d *testImageDiscoverer) Name() string {
+	return "image"
+}
+
+func (d *testImageDiscoverer) RequiresPod() bool {
+	return true
+}
+
+func (d *testImageDiscoverer) imageKey(t *DiscoveryTarget) string {
+	return t.Pod.Spec.Containers[0].Image
+}
+
+func (d *testImageDiscoverer) Discover(ctx context.Context, t *DiscoveryTarget) (string, error) {
+	d.mu.Lock()
+	d.calls++
+	d.running++
+	if d.running > d.max {
+		d.max = d.running
+	}
+	d.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	d.mu.Lock()
+	d.running--
+	d.mu.Unlock()
+	return "/work/logs", nil
+}
+
+func TestDiscoverPodsBounded(t *testing.T) {
+	var pods []*corev1.Pod
+	for i := 0; i < 6; i++ {
+		pods = append(pods, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app-" + strconv.Itoa(i)},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "demo/app:" + strconv.Itoa(i%3)}}},
+		})
+	}
+	dc := &testImageDiscoverer{}
+	target := DiscoveryTarget{Container: &corev1.Container{Name: "app"}}
+	logPaths, err := discoverPods(context.Background(), dc, target, pods, make(chan struct{}, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logPaths) != 1 || logPaths[0] != "/work/logs" {
+		t.Fatalf("unexpected log paths: %v", logPaths)
+	}
+	if dc.calls != 3 || dc.max > 2 {
+		t.Fatalf("unexpected probes: %d calls, %d concurrent", dc.calls, dc.max)
+	}
+}
+
+// buildTestWorkload builds an enabled spec-only workload, container app declares /work/logs in env,
+// mapped already if mapped is true, patches return patchErr and are recorded in patched if not nil
+func buildTestWorkload(name string, mapped bool, patchErr error, patched *metav1.PatchOptions) *Workload {
+	spec := corev1.PodSpec{Containers: []corev1.Container{
+		{Name: "app", Env: []corev1.EnvVar{{Name: EnvLogtubeAutoMapping, Value: "/work/logs"}}},
+	}}
+	if mapped {
+		wp := newWorkloadPatch("default", name)
+		wp.addVolumeMount("app", []string{"/work/logs"})
+		spec = *wp.mergeInto(&spec)
+	}
+	return &Workload{
+		Kind:        KindCronJob,
+		Namespace:   "default",
+		Name:        name,
+		Annotations: map[string]string{AnnotationLogtubeAutoMappingEnabled: "true"},
+		Template:    &corev1.PodTemplateSpec{Spec: spec},
+		SpecOnly:    true,
+		patch: func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+			if patched != nil {
+				*patched = opts
+			}
+			return patchErr
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	optValidate = true
+	defer func() { optValidate = false }()
+
+	var opts metav1.PatchOptions
+	buildWorkload := func(name string, patchErr error) *Workload {
+		return buildTestWorkload(name, false, patchErr, &opts)
+	}
+	m := &Mapper{chain: []Discoverer{specEnvDiscoverer{}}, report: &Report{}}
+	if err := m.processWorkload(context.Background(), buildWorkload("valid", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.DryRun) != 1 || opts.DryRun[0] != metav1.DryRunAll {
+		t.Fatalf("unexpected dry run: %v", opts.DryRun)
+	}
+	invalid := apierrors.NewInvalid(schema.GroupKind{Group: "batch", Kind: "CronJob"}, "invalid", nil)
+	if err := m.processWorkload(context.Background(), buildWorkload("invalid", invalid)); err != nil {
+		t.Fatal(err)
+	}
+	if m.report.count(ResultCreated) != 1 || m.report.count(ResultInvalid) != 1 {
+		t.Fatalf("unexpected report: %+v", m.report.entries)
+	}
+}
+
+func TestServerSideAdopt(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	serverSide := optServerSide
+	t.Cleanup(func() { optServerSide = serverSide })
+	optServerSide = true
+
+	var opts metav1.PatchOptions
+	wl := buildTestWorkload("demo", true, nil, &opts)
+	wl.APIVersion, wl.ObjectKind = "batch/v1beta1", "CronJob"
+	wl.TemplatePath = []string{"spec", "jobTemplate", "spec", "template"}
+	m := &Mapper{chain: []Discoverer{specEnvDiscoverer{}}, report: &Report{}}
+	// mapped by a strategic merge patch before, applied to take the ownership
+	if err := m.processWorkload(context.Background(), wl); err != nil {
+		t.Fatal(err)
+	}
+	if opts.FieldManager != FieldManagerLogtubeAutoMapping {
+		t.Fatalf("unexpected patch options: %+v", opts)
+	}
+	// applied already, no patch
+	opts = metav1.PatchOptions{}
+	wl.ApplyManagers = []string{FieldManagerLogtubeAutoMapping}
+	if err := m.processWorkload(context.Background(), wl); err != nil {
+		t.Fatal(err)
+	}
+	if opts.FieldManager != "" {
+		t.Fatalf("unexpected patch options: %+v", opts)
+	}
+	if m.report.count(ResultUnchanged) != 2 {
+		t.Fatalf("unexpected report: %+v", m.report.entries)
+	}
+}
+
+func TestUnmapOptedOut(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	wp := newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	spec := corev1.PodSpec{
+		Volumes: wp.Spec.Template.Spec.Volumes,
+		Containers: []corev1.Container{
+			{Name: "app", VolumeMounts: wp.Spec.Template.Spec.Containers[0].VolumeMounts},
+		},
+	}
+	var (
+		patchType types.PatchType
+		patch     []byte
+	)
+	wl := &Workload{
+		Kind:      KindDeployment,
+		Namespace: "default",
+		Name:      "demo",
+		Template:  &corev1.PodTemplateSpec{Spec: spec},
+		patch: func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+			patchType, patch = pt, data
+			return nil
+		},
+	}
+	m := &Mapper{report: &Report{}}
+	if err := m.processWorkload(context.Background(), wl); err != nil {
+		t.Fatal(err)
+	}
+	if m.report.count(ResultUnmapped) != 1 {
+		t.Fatalf("unexpected report: %+v", m.report.entries)
+	}
+	expected := `{"spec":{"template":{"spec":{"containers":[{"name":"app","volumeMounts":[{"$patch":"delete","mountPath":"/work/logs"}]}],"volumes":[{"$patch":"delete","name":"vol-logtube-auto-mapping-app"}]}}}}`
+	if patchType != types.StrategicMergePatchType || string(patch) != expected {
+		t.Fatalf("unexpected patch: %s %s", patchType, patch)
+	}
+}
+
+func TestUnmapReportEntry(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Group: "batch", Resource: "cronjobs"}, "broken", errors.New("denied"))
+	report := &Report{}
+	for _, wl := range []*Workload{
+		buildTestWorkload("broken", true, forbidden, nil),
+		buildTestWorkload("demo", true, nil, nil),
+		buildTestWorkload("unmapped", false, nil, nil),
+	} {
+		report.addEntry(unmapReportEntry(context.Background(), wl))
+	}
+	if report.count(ResultFailed) != 1 || report.count(ResultUnmapped) != 1 || report.count(ResultUnchanged) != 1 {
+		t.Fatalf("unexpected report: %+v", report.entries)
+	}
+
+	namespace, allNamespaces := optNamespace, optAllNamespaces
+	t.Cleanup(func() { optNamespace, optAllNamespaces = namespace, allNamespaces })
+	optNamespace, optAllNamespaces = "", false
+	if err := runUnmap(context.Background(), nil, nil); err == nil {
+		t.Fatal("expected error without --namespace or --all-namespaces")
+	}
+}
+
+func TestBuildApplyPatch(t *testing.T) {
+	optHostPath = "/data/logtube-logs"
+	wp := newWorkloadPatch("default", "demo")
+	wp.addVolumeMount("app", []string{"/work/logs"})
+	wl := &Workload{
+		Kind:       KindCronJob,
+		Namespace:  "default",
+		Name:       "demo",
+		APIVersion: "batch/v1beta1",
+		ObjectKind: "CronJob",
+		ApplyManagers: applyManagers([]metav1.ManagedFieldsEntry{
+			{Manager: "helm", Operation: metav1.ManagedFieldsOperationUpdate},
+			{Manager: FieldManagerLogtubeAutoMapping, Operation: metav1.ManagedFieldsOperationApply},
+		}),
+		TemplatePath: []string{"spec", "jobTemplate", "spec", "template"},
+	}
+	if !wl.appliedBy(FieldManagerLogtubeAutoMapping) || wl.appliedBy("helm") {
+		t.Fatalf("unexpected apply managers: %v", wl.ApplyManagers)
+	}
+	data, err := wl.buildApplyPatch(wp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"apiVersion":"batch/v1beta1","kind":"CronJob","metadata":{"name":"demo","namespace":"default"},` +
+		`"spec":{"jobTemplate":{"spec":{"template":{"spec":{"containers":[{"name":"app","volumeMounts":[{"name":"vol-logtube-auto-mapping-app","mountPath":"/work/logs"}]}],` +
+		`"volumes":[{"name":"vol-logtube-auto-mapping-app","hostPath":{"path":"/data/logtube-logs/default-demo/app","type":"DirectoryOrCreate"}}]}}}}}}`
+	if string(data) != expected {
+		t.Fatalf("unexpected apply patch: %s", data)
+	}
+
+	wl.ObjectKind = ""
+	if _, err = wl.buildApplyPatch(wp); err == nil {
+		t.Fatal("expect error for unknown object type")
+	}
+
+	// custom workloads keep using JSON patch
+	optServerSide = true
+	defer func() { optServerSide = false }()
+	if !wl.serverSide() {
+		t.Fatal("expect server-side apply for built-in kinds")
+	}
+	wl.JSONPatch = true
+	if wl.serverSide() {
+		t.Fatal("expect no server-side apply for custom workloads")
+	}
+}
+
+func TestPatchRetrying(t *testing.T) {
+	backoff := apiBackoff
+	apiBackoff.Duration = time.Millisecond
+	defer func() { apiBackoff = backoff }()
+
+	var calls int
+	var errs []error
+	wl := &Workload{
+		Kind: KindDeployment,
+		Name: "demo",
+		patch: func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) (err error) {
+			if calls < len(errs) {
+				err = errs[calls]
+			}
+			calls++
+			return
+		},
+	}
+	gr := schema.GroupResource{Group: "apps", Resource: "deployments"}
+
+	errs = []error{apierrors.NewServiceUnavailable("unavailable"), apierrors.NewConflict(gr, "demo", errors.New("modified"))}
+	if err := wl.patchRetrying(context.Background(), types.StrategicMergePatchType, nil, metav1.PatchOptions{}); err != nil || calls != 3 {
+		t.Fatalf("unexpected result: %v, %d calls", err, calls)
+	}
+
+	// conflicts between field managers are never retried
+	calls = 0
+	errs = []error{apierrors.NewConflict(gr, "demo", errors.New("field conflict"))}
+	if err := wl.patchRetrying(context.Background(), types.ApplyPatchType, nil, metav1.PatchOptions{}); !apierrors.IsConflict(err) || calls != 1 {
+		t.Fatalf("unexpected result: %v, %d calls", err, calls)
+	}
+
+	// non-retriable errors fail immediately, retriable ones fail after backoff exhausted
+	calls = 0
+	errs = []error{apierrors.NewForbidden(gr, "demo", errors.New("denied"))}
+	if err := wl.patchRetrying(context.Background(), types.StrategicMergePatchType, nil, metav1.PatchOptions{}); !apierrors.IsForbidden(err) || calls != 1 {
+		t.Fatalf("unexpected result: %v, %d calls", err, calls)
+	}
+	calls = 0
+	errs = []error{}
+	for i := 0; i < apiBackoff.Steps+1; i++ {
+		errs = append(errs, apierrors.NewInternalError(errors.New("etcd")))
+	}
+	if err := wl.patchRetrying(context.Background(), types.StrategicMergePatchType, nil, metav1.PatchOptions{}); !apierrors.IsInternalError(err) || calls != apiBackoff.Steps {
+		t.Fatalf("unexpected result: %v, %d calls", err, calls)
+	}
+}
+
+func TestDiscoveryMissSkipped(t *testing.T) {
+	wl := &Workload{
+		Kind:        KindDeployment,
+		Namespace:   "default",
+		Name:        "demo",
+		Annotations: map[string]string{AnnotationLogtubeAutoMappingEnabled: "true"},
+		Template:    &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}},
+	}
+	m := &Mapper{chain: []Discoverer{specEnvDiscoverer{}, testPodDiscoverer{}}, report: &Report{}}
+	// scaled to zero
+	d := &Discovery{Chain: m.chain, Spec: &wl.Template.Spec, Pods: func(ctx context.Context) ([]*corev1.Pod, error) {
+		return nil, errors.New("status.replicas == 0")
+	}}
+	if _, err := d.Run(context.Background()); err == nil {
+		t.Fatal("expect error")
+	} else if _, ok := err.(*PodListError); ok {
+		t.Fatalf("unexpected pod list error: %s", err.Error())
+	}
+	d.Pods = func(ctx context.Context) ([]*corev1.Pod, error) {
+		return nil, apierrors.NewServiceUnavailable("unavailable")
+	}
+	if _, err := d.Run(context.Background()); err == nil {
+		t.Fatal("expect error")
+	} else if _, ok := err.(*PodListError); !ok {
+		t.Fatalf("expect pod list error, got: %s", err.Error())
+	}
+
+	wl.SpecOnly = true
+	if err := m.processWorkload(context.Background(), wl); err != nil {
+		t.Fatal(err)
+	}
+	if m.report.count(ResultSkipped) != 1 || m.report.count(ResultFailed) != 0 {
+		t.Fatalf("unexpected report: %+v", m.report.entries)
+	}
+
+	// exec forbidden, counted as failed
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "pods/exec"}, "demo-1", errors.New("denied"))
+	m.chain = []Discoverer{specEnvDiscoverer{}, testFailingDiscoverer{err: forbidden}}
+	if err := m.processWorkload(context.Background(), wl); err != nil {
+		t.Fatal(err)
+	}
+	if m.report.count(ResultSkipped) != 1 || m.report.count(ResultFailed) != 1 {
+		t.Fatalf("unexpected report: %+v", m.report.entries)
+	}
+}
+
+type testFailingDiscoverer struct {
+	err error
+}
+
+func (d testFailingDiscoverer) Name() string {
+	return "failing"
+}
+
+func (d testFailingDiscoverer) RequiresPod() bool {
+	return false
+}
+
+func (d testFailingDiscoverer) Discover(ctx context.Context, t *DiscoveryTarget) (string, error) {
+	return "", d.err
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"log"
+	"strings"
+)
+
+const (
+	LegacyHostPath = "filebeat-collect-logs"
+)
+
+type MigrateContainerPatch struct {
+	Name         string                   `json:"name"`
+	Env          []map[string]interface{} `json:"env,omitempty"`
+	VolumeMounts []map[string]interface{} `json:"volumeMounts,omitempty"`
+}
+
+type MigratePatch struct {
+	Spec struct {
+		Template struct {
+			Spec struct {
+				Containers []MigrateContainerPatch  `json:"containers,omitempty"`
+				Volumes    []map[string]interface{} `json:"volumes,omitempty"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+// migrateWorkload replaces legacy filebeat-collect-logs volumes with LOGTUBE_K8S_AUTO_MAPPING environment variable
+func migrateWorkload(ctx context.Context, wl *Workload) (err error) {
+	// legacy volumes only exist in deployments and statefulsets
+	if wl.Kind != KindDeployment && wl.Kind != KindStatefulSet {
+		return
+	}
+
+	log.Printf("%s: [%s]", wl.Kind, wl.Name)
+
+	if !wl.enabled() {
+		return
+	}
+
+	var p MigratePatch
+
+	var volumeNames []string
+
+	for _, v := range wl.Template.Spec.Volumes {
+		if v.HostPath != nil {
+			if strings.Contains(v.HostPath.Path, LegacyHostPath) {
+				// delete volume
+				p.Spec.Template.Spec.Volumes = append(p.Spec.Template.Spec.Volumes, map[string]interface{}{
+					"$patch": "delete",
+					"name":   v.Name,
+				})
+				// record volume names
+				volumeNames = append(volumeNames, v.Name)
+			}
+		}
+	}
+
+	if len(volumeNames) == 0 {
+		return
+	}
+
+	for _, c := range wl.Template.Spec.Containers {
+		var found bool
+		cp := MigrateContainerPatch{Name: c.Name}
+
+	loopVM:
+		for _, vm := range c.VolumeMounts {
+			for _, vn := range volumeNames {
+				if vm.Name == vn {
+					cp.VolumeMounts = append(cp.VolumeMounts, map[string]interface{}{
+						"$patch":    "delete",
+						"mountPath": vm.MountPath,
+					})
+
+					cp.Env = append(cp.Env, map[string]interface{}{
+						"name":  EnvLogtubeAutoMapping,
+						"value": vm.MountPath,
+					})
+					found = true
+					break loopVM
+				}
+			}
+		}
+
+		if found {
+			p.Spec.Template.Spec.Containers = append(p.Spec.Template.Spec.Containers, cp)
+		}
+	}
+
+	var buf []byte
+	if buf, err = json.Marshal(p); err != nil {
+		return
+	}
+
+	log.Println(string(buf))
+
+	if !optDryRun {
+		if err = wl.patchRetrying(ctx, types.StrategicMergePatchType, buf, metav1.PatchOptions{}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// runMigrate migrates all workloads in scope from legacy filebeat-collect-logs volumes
+func runMigrate(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset) error {
+	return walkWorkloads(ctx, cfg, client, func(wl *Workload) error {
+		return migrateWorkload(ctx, wl)
+	})
+}
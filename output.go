@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+var (
+	optOutput = os.Getenv("AUTO_LOGTUBE_MAPPING_OUTPUT")
+)
+
+// outputFormat validates --output, text by default
+func outputFormat() (string, error) {
+	switch optOutput {
+	case "", OutputText:
+		return OutputText, nil
+	case OutputJSON:
+		return OutputJSON, nil
+	default:
+		return "", fmt.Errorf("invalid output format '%s', expect '%s' or '%s'", optOutput, OutputText, OutputJSON)
+	}
+}
+
+// buildSpecDiff renders an unified diff of pod specs in YAML
+func buildSpecDiff(before, after *corev1.PodSpec) (diff string, err error) {
+	var a, b []byte
+	if a, err = yaml.Marshal(before); err != nil {
+		return
+	}
+	if b, err = yaml.Marshal(after); err != nil {
+		return
+	}
+	diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(a)),
+		B:        difflib.SplitLines(string(b)),
+		FromFile: "spec.template.spec (before)",
+		ToFile:   "spec.template.spec (after)",
+		Context:  3,
+	})
+	return
+}
+
+// logDryRun logs the diff and the raw patch line by line
+func logDryRun(scopeLog func(s string), e *ReportEntry) {
+	for _, line := range strings.Split(strings.TrimRight(e.Diff, "\n"), "\n") {
+		scopeLog("  " + line)
+	}
+	scopeLog("patch (" + e.PatchType + "): " + string(e.Patch))
+}
+
+// reportDocument is the machine-readable report, printed with --output json
+type reportDocument struct {
+	DryRun    bool           `json:"dryRun"`
+	Summary   map[string]int `json:"summary"`
+	Workloads []ReportEntry  `json:"workloads"`
+}
+
+// PrintJSON writes the report as a JSON document
+func (r *Report) PrintJSON(w io.Writer) error {
+	doc := reportDocument{DryRun: optDryRun, Summary: map[string]int{}}
+	for _, result := range reportResults {
+		doc.Summary[result] = r.count(result)
+	}
+	r.mu.Lock()
+	doc.Workloads = append([]ReportEntry{}, r.entries...)
+	r.mu.Unlock()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	AnnotationDeploymentRevision = "deployment.kubernetes.io/revision"
+)
+
+var (
+	optProbePods = os.Getenv("AUTO_LOGTUBE_MAPPING_PROBE_PODS")
+)
+
+// probePodsLimit parses --probe-pods, 1 by default, 0 for all pods
+func probePodsLimit() (n int, err error) {
+	switch optProbePods {
+	case "":
+		n = 1
+	case "all":
+		n = 0
+	default:
+		if n, err = strconv.Atoi(optProbePods); err != nil || n < 1 {
+			err = errors.New("invalid --probe-pods, must be a positive number or 'all': " + optProbePods)
+		}
+	}
+	return
+}
+
+// deploymentRevision finds pod-template-hash of the replicaset matching current revision of deployment
+func deploymentRevision(ctx context.Context, client *kubernetes.Clientset, dp *appsv1.Deployment) (key, value string, err error) {
+	revision := dp.Annotations[AnnotationDeploymentRevision]
+	if revision == "" {
+		return
+	}
+	var selector string
+	if selector, err = buildSelector(dp.Spec.Selector); err != nil {
+		return
+	}
+	var rsList *appsv1.ReplicaSetList
+	if err = retryAPI(ctx, isRetriable, func() (err error) {
+		rsList, err = client.AppsV1().ReplicaSets(dp.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		return
+	}); err != nil {
+		return
+	}
+	for _, rs := range rsList.Items {
+		if !metav1.IsControlledBy(&rs, dp) || rs.Annotations[AnnotationDeploymentRevision] != revision {
+			continue
+		}
+		if value = rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; value != "" {
+			key = appsv1.DefaultDeploymentUniqueLabelKey
+		}
+		return
+	}
+	return
+}
+
+// daemonSetRevision finds controller-revision-hash of the latest controller revision of daemonset
+func daemonSetRevision(ctx context.Context, client *kubernetes.Clientset, ds *appsv1.DaemonSet) (key, value string, err error) {
+	var selector string
+	if selector, err = buildSelector(ds.Spec.Selector); err != nil {
+		return
+	}
+	var crList *appsv1.ControllerRevisionList
+	if err = retryAPI(ctx, isRetriable, func() (err error) {
+		crList, err = client.AppsV1().ControllerRevisions(ds.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		return
+	}); err != nil {
+		return
+	}
+	var latest *appsv1.ControllerRevision
+	for i, cr := range crList.Items {
+		if !metav1.IsControlledBy(&cr, ds) {
+			continue
+		}
+		if latest == nil || cr.Revision > latest.Revision {
+			latest = &crList.Items[i]
+		}
+	}
+	if latest == nil {
+		return
+	}
+	if value = latest.Labels[appsv1.ControllerRevisionHashLabelKey]; value != "" {
+		key = appsv1.ControllerRevisionHashLabelKey
+	}
+	return
+}
+
+// ownerUIDs returns UIDs of the workload and replicasets or replicationcontrollers controlled by it, pods are controlled by either of them,
+// Pod -> ReplicaSet -> Deployment / Rollout, Pod -> ReplicationController -> DeploymentConfig, or Pod -> StatefulSet / DaemonSet,
+// nil if workload UID is unknown
+func (wl *Workload) ownerUIDs(ctx context.Context, client *kubernetes.Clientset, selector string) (uids map[types.UID]bool, err error) {
+	if wl.UID == "" {
+		return
+	}
+	uids = map[types.UID]bool{wl.UID: true}
+	// statefulsets and daemonsets own pods directly
+	if wl.Kind == KindStatefulSet || wl.Kind == KindDaemonSet {
+		return
+	}
+	var rsList *appsv1.ReplicaSetList
+	if err = retryAPI(ctx, isRetriable, func() (err error) {
+		rsList, err = client.AppsV1().ReplicaSets(wl.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		return
+	}); err != nil {
+		return
+	}
+	for i := range rsList.Items {
+		addControlledUID(uids, wl.UID, &rsList.Items[i])
+	}
+	if wl.Kind == KindDeployment {
+		return
+	}
+	// custom workloads, e.g. DeploymentConfig, may control pods with replicationcontrollers
+	var rcList *corev1.ReplicationControllerList
+	if err = retryAPI(ctx, isRetriable, func() (err error) {
+		rcList, err = client.CoreV1().ReplicationControllers(wl.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		return
+	}); err != nil {
+		return
+	}
+	for i := range rcList.Items {
+		addControlledUID(uids, wl.UID, &rcList.Items[i])
+	}
+	return
+}
+
+// addControlledUID adds UID of the object to uids, if it's controlled by owner
+func addControlledUID(uids map[types.UID]bool, owner types.UID, obj metav1.Object) {
+	if ref := metav1.GetControllerOf(obj); ref != nil && ref.UID == owner {
+		uids[obj.GetUID()] = true
+	}
+}
+
+// filterOwnedPods returns pods controlled by any of owners, all pods if owners is nil
+func filterOwnedPods(pods []corev1.Pod, owners map[types.UID]bool) []corev1.Pod {
+	if owners == nil {
+		return pods
+	}
+	var owned []corev1.Pod
+	for _, pod := range pods {
+		if ref := metav1.GetControllerOf(&pod); ref != nil && owners[ref.UID] {
+			owned = append(owned, pod)
+		}
+	}
+	return owned
+}
+
+// selectPods chooses at most limit running and ready pods, all of them if limit is 0, from the current revision if revision key is given,
+// the reason of choice, or why no pod is eligible, is returned
+func selectPods(pods []corev1.Pod, revisionKey, revisionValue string, limit int) (selected []*corev1.Pod, reason string, err error) {
+	var terminating, notRunning, notReady, oldRevision int
+	for i := range pods {
+		p := &pods[i]
+		switch {
+		case p.DeletionTimestamp != nil:
+			terminating++
+		case p.Status.Phase != corev1.PodRunning:
+			notRunning++
+		case !isPodReady(p):
+			notReady++
+		case revisionKey != "" && p.Labels[revisionKey] != revisionValue:
+			oldRevision++
+		default:
+			if limit == 0 || len(selected) < limit {
+				selected = append(selected, p)
+			}
+		}
+	}
+	if len(selected) > 0 {
+		reason = "running and ready"
+		if revisionKey != "" {
+			reason += ", " + revisionKey + "=" + revisionValue
+		} else {
+			reason += ", revision unknown"
+		}
+		return
+	}
+	var details []string
+	for _, item := range []struct {
+		n    int
+		desc string
+	}{
+		{terminating, "terminating"},
+		{notRunning, "not running"},
+		{notReady, "not ready"},
+		{oldRevision, "from previous revisions"},
+	} {
+		if item.n > 0 {
+			details = append(details, fmt.Sprintf("%d %s", item.n, item.desc))
+		}
+	}
+	if len(pods) == 0 {
+		err = errors.New("no pods")
+	} else {
+		err = fmt.Errorf("no eligible pod in %d pods: %s", len(pods), strings.Join(details, ", "))
+	}
+	return
+}
+
+// findPods returns running and ready pods of the current pod template, for discoverers requiring pod
+func (wl *Workload) findPods(ctx context.Context, client *kubernetes.Clientset, log func(s string)) (pods []*corev1.Pod, err error) {
+	var limit int
+	if limit, err = probePodsLimit(); err != nil {
+		return
+	}
+	// check status.replicas, or status.desiredNumberScheduled for daemonset
+	if wl.Replicas == 0 {
+		if wl.Kind == KindDaemonSet {
+			err = errors.New("status.desiredNumberScheduled == 0")
+		} else {
+			err = errors.New("status.replicas == 0")
+		}
+		return
+	}
+	// check selector
+	var selector string
+	if selector, err = buildSelector(wl.Selector); err != nil {
+		err = fmt.Errorf("%s/%s: %s", wl.Namespace, wl.Name, err.Error())
+		return
+	}
+	// current revision
+	var revisionKey, revisionValue string
+	if wl.revision != nil {
+		if revisionKey, revisionValue, err = wl.revision(ctx); err != nil {
+			return
+		}
+	}
+	// list pods
+	var podList *corev1.PodList
+	if err = retryAPI(ctx, isRetriable, func() (err error) {
+		podList, err = client.CoreV1().Pods(wl.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		return
+	}); err != nil {
+		return
+	}
+	// pods of other workloads with overlapping labels
+	var owners map[types.UID]bool
+	if owners, err = wl.ownerUIDs(ctx, client, selector); err != nil {
+		return
+	}
+	candidates := filterOwnedPods(podList.Items, owners)
+	if n := len(podList.Items) - len(candidates); n > 0 && log != nil {
+		log(fmt.Sprintf("%d pods matching selector are not owned by workload, ignored", n))
+	}
+	var reason string
+	if pods, reason, err = selectPods(candidates, revisionKey, revisionValue, limit); err != nil {
+		return
+	}
+	if log != nil {
+		var names []string
+		for _, pod := range pods {
+			names = append(names, pod.Name)
+		}
+		log(fmt.Sprintf("pod [%s]: %s", strings.Join(names, ", "), reason))
+	}
+	return
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	LabelLogtubeAutoMappingPath = "io.github.logtube.auto-mapping.path"
+
+	registryDockerHub     = "registry-1.docker.io"
+	registryMaxBodyLength = 4 * 1024 * 1024
+)
+
+var (
+	optRegistryInsecure = os.Getenv("AUTO_LOGTUBE_MAPPING_REGISTRY_INSECURE")
+	optRegistryPlatform = os.Getenv("AUTO_LOGTUBE_MAPPING_REGISTRY_PLATFORM")
+)
+
+var (
+	registryManifestMediaTypes = []string{
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+	}
+
+	regexpChallengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// ImageReference is a parsed image reference, Reference is either a tag or a digest
+type ImageReference struct {
+	Host       string
+	Repository string
+	Reference  string
+}
+
+func (ref ImageReference) String() string {
+	if strings.HasPrefix(ref.Reference, "sha256:") {
+		return ref.Host + "/" + ref.Repository + "@" + ref.Reference
+	}
+	return ref.Host + "/" + ref.Repository + ":" + ref.Reference
+}
+
+// parseImageReference parses image reference like docker does, nginx is short for registry-1.docker.io/library/nginx:latest
+func parseImageReference(image string) (ref ImageReference, err error) {
+	image = strings.TrimPrefix(image, "docker-pullable://")
+	if image == "" {
+		err = errors.New("empty image reference")
+		return
+	}
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Reference = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i+1:], "/") {
+		name, ref.Reference = name[:i], name[i+1:]
+	}
+	if ref.Reference == "" {
+		ref.Reference = "latest"
+	}
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		ref.Host, ref.Repository = name[:i], name[i+1:]
+	} else {
+		ref.Host, ref.Repository = registryDockerHub, name
+	}
+	if ref.Host == "docker.io" || ref.Host == "index.docker.io" {
+		ref.Host = registryDockerHub
+	}
+	if ref.Host == registryDockerHub && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	if ref.Repository == "" {
+		err = errors.New("invalid image reference: " + image)
+	}
+	return
+}
+
+// resolveContainerImage returns the image reference of a running container, pinned to digest from pod status if possible
+func resolveContainerImage(pod *corev1.Pod, containerName string) (ref ImageReference, err error) {
+	image := ""
+	for _, c := range pod.Spec.Containers {
+		if c.Name == containerName {
+			image = c.Image
+		}
+	}
+	if ref, err = parseImageReference(image); err != nil {
+		return
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != containerName {
+			continue
+		}
+		// docker-pullable://nginx@sha256:..., or docker.io/library/nginx@sha256:... with containerd
+		if i := strings.LastIndex(cs.ImageID, "@"); i >= 0 {
+			var pinned ImageReference
+			if pinned, err = parseImageReference(cs.ImageID); err != nil {
+				return
+			}
+			if pinned.Host == ref.Host && pinned.Repository == ref.Repository {
+				ref.Reference = cs.ImageID[i+1:]
+			}
+		}
+	}
+	return
+}
+
+// dockerConfigEntry is an entry of .dockerconfigjson or .dockercfg
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+func (e dockerConfigEntry) credentials() (username, password string) {
+	if e.Username != "" || e.Password != "" {
+		return e.Username, e.Password
+	}
+	if buf, err := base64.StdEncoding.DecodeString(e.Auth); err == nil {
+		if splits := strings.SplitN(string(buf), ":", 2); len(splits) == 2 {
+			return splits[0], splits[1]
+		}
+	}
+	return
+}
+
+// normalizeRegistryHost normalizes keys of docker config like https://index.docker.io/v1/
+func normalizeRegistryHost(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		s = u.Host
+	}
+	s = strings.TrimSuffix(s, "/")
+	if s == "docker.io" || s == "index.docker.io" {
+		s = registryDockerHub
+	}
+	return s
+}
+
+// lookupRegistryCredentials finds credentials for host from imagePullSecrets of pod
+func lookupRegistryCredentials(ctx context.Context, src envSource, pod *corev1.Pod, host string) (username, password string, err error) {
+	for _, ps := range pod.Spec.ImagePullSecrets {
+		var data map[string][]byte
+		if data, err = src.secret(ctx, pod.Namespace, ps.Name); err != nil {
+			return
+		}
+		auths := map[string]dockerConfigEntry{}
+		if buf, ok := data[corev1.DockerConfigJsonKey]; ok {
+			var cfg struct {
+				Auths map[string]dockerConfigEntry `json:"auths"`
+			}
+			if err = json.Unmarshal(buf, &cfg); err != nil {
+				return
+			}
+			auths = cfg.Auths
+		} else if buf, ok := data[corev1.DockerConfigKey]; ok {
+			if err = json.Unmarshal(buf, &auths); err != nil {
+				return
+			}
+		}
+		for key, entry := range auths {
+			if normalizeRegistryHost(key) == host {
+				username, password = entry.credentials()
+				return
+			}
+		}
+	}
+	return
+}
+
+// registryClient is a minimal client of OCI / Docker registry v2 API, supports basic and bearer token authentication
+type registryClient struct {
+	client   *http.Client
+	ref      ImageReference
+	insecure bool
+	username string
+	password string
+	token    string
+}
+
+func (rc *registryClient) buildURL(kind, reference string) string {
+	scheme := "https"
+	if rc.insecure {
+		scheme = "http"
+	}
+	return scheme + "://" + rc.ref.Host + "/v2/" + rc.ref.Repository + "/" + kind + "/" + reference
+}
+
+// authenticate handles the WWW-Authenticate challenge
+func (rc *registryClient) authenticate(ctx context.Context, challenge string) (err error) {
+	if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+		if rc.username == "" && rc.password == "" {
+			err = errors.New("registry requires basic authentication, no imagePullSecrets matched")
+		}
+		return
+	}
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer") {
+		err = errors.New("unsupported registry authentication: " + challenge)
+		return
+	}
+	params := map[string]string{}
+	for _, match := range regexpChallengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		err = errors.New("missing realm in registry authentication: " + challenge)
+		return
+	}
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		q.Set("scope", params["scope"])
+	} else {
+		q.Set("scope", "repository:"+rc.ref.Repository+":pull")
+	}
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, params["realm"]+"?"+q.Encode(), nil); err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	if rc.username != "" || rc.password != "" {
+		req.SetBasicAuth(rc.username, rc.password)
+	}
+	var res *http.Response
+	if res, err = rc.client.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to retrieve registry token: %s", res.Status)
+		return
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(io.LimitReader(res.Body, registryMaxBodyLength)).Decode(&token); err != nil {
+		return
+	}
+	if rc.token = token.Token; rc.token == "" {
+		rc.token = token.AccessToken
+	}
+	if rc.token == "" {
+		err = errors.New("empty registry token")
+	}
+	return
+}
+
+// get fetches a manifest or a blob, authenticates and retries once on 401
+func (rc *registryClient) get(ctx context.Context, u string, accept []string) (buf []byte, contentType string, err error) {
+	for retry := 0; ; retry++ {
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodGet, u, nil); err != nil {
+			return
+		}
+		req = req.WithContext(ctx)
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if rc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+rc.token)
+		} else if rc.username != "" || rc.password != "" {
+			req.SetBasicAuth(rc.username, rc.password)
+		}
+		var res *http.Response
+		if res, err = rc.client.Do(req); err != nil {
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(res.Body, registryMaxBodyLength))
+		_ = res.Body.Close()
+		if err != nil {
+			return
+		}
+		if res.StatusCode == http.StatusUnauthorized && retry == 0 {
+			if err = rc.authenticate(ctx, res.Header.Get("WWW-Authenticate")); err != nil {
+				return
+			}
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			err = fmt.Errorf("failed to get %s: %s", u, res.Status)
+			return
+		}
+		contentType = res.Header.Get("Content-Type")
+		return
+	}
+}
+
+// registryManifest is either an image manifest or an image index / manifest list
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// registryImageConfig is the image config blob
+type registryImageConfig struct {
+	Config struct {
+		Env    []string          `json:"Env"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// fetchImageConfig resolves manifest, image index is resolved with platform, and fetches the image config
+func (rc *registryClient) fetchImageConfig(ctx context.Context) (cfg registryImageConfig, err error) {
+	platform := optRegistryPlatform
+	if platform == "" {
+		platform = "linux/amd64"
+	}
+
+	reference := rc.ref.Reference
+	var manifest registryManifest
+	for depth := 0; ; depth++ {
+		var buf []byte
+		if buf, _, err = rc.get(ctx, rc.buildURL("manifests", reference), registryManifestMediaTypes); err != nil {
+			return
+		}
+		manifest = registryManifest{}
+		if err = json.Unmarshal(buf, &manifest); err != nil {
+			return
+		}
+		if len(manifest.Manifests) == 0 {
+			break
+		}
+		if depth > 0 {
+			err = errors.New("nested image index is not supported")
+			return
+		}
+		reference = ""
+		for _, m := range manifest.Manifests {
+			if m.Platform.OS+"/"+m.Platform.Architecture == platform {
+				reference = m.Digest
+				break
+			}
+		}
+		if reference == "" {
+			err = fmt.Errorf("no manifest for platform %s in %s", platform, rc.ref.String())
+			return
+		}
+	}
+	if manifest.Config.Digest == "" {
+		err = errors.New("missing config in manifest of " + rc.ref.String())
+		return
+	}
+
+	var buf []byte
+	if buf, _, err = rc.get(ctx, rc.buildURL("blobs", manifest.Config.Digest), nil); err != nil {
+		return
+	}
+	if strings.HasPrefix(manifest.Config.Digest, "sha256:") {
+		sum := sha256.Sum256(buf)
+		if "sha256:"+hex.EncodeToString(sum[:]) != manifest.Config.Digest {
+			err = errors.New("digest mismatch of image config " + manifest.Config.Digest)
+			return
+		}
+	}
+	err = json.Unmarshal(buf, &cfg)
+	return
+}
+
+// registryDiscoverer reads log path from image config, either env LOGTUBE_K8S_AUTO_MAPPING or label io.github.logtube.auto-mapping.path,
+// works for distroless and scratch images without shell
+type registryDiscoverer struct {
+	src    envSource
+	client *http.Client
+}
+
+func (d *registryDiscoverer) Name() string {
+	return DiscovererRegistry
+}
+
+func (d *registryDiscoverer) RequiresPod() bool {
+	return true
+}
+
+func (d *registryDiscoverer) imageKey(t *DiscoveryTarget) string {
+	ref, err := resolveContainerImage(t.Pod, t.Container.Name)
+	if err != nil {
+		return ""
+	}
+	return ref.String()
+}
+
+func (d *registryDiscoverer) Discover(ctx context.Context, t *DiscoveryTarget) (logPath string, err error) {
+	rc := &registryClient{client: d.client}
+	if rc.ref, err = resolveContainerImage(t.Pod, t.Container.Name); err != nil {
+		return
+	}
+	for _, host := range strings.Split(optRegistryInsecure, ",") {
+		if strings.TrimSpace(host) == rc.ref.Host {
+			rc.insecure = true
+		}
+	}
+	if d.src != nil {
+		if rc.username, rc.password, err = lookupRegistryCredentials(ctx, d.src, t.Pod, rc.ref.Host); err != nil {
+			return
+		}
+	}
+	var cfg registryImageConfig
+	if cfg, err = rc.fetchImageConfig(ctx); err != nil {
+		return
+	}
+	for _, env := range cfg.Config.Env {
+		if strings.HasPrefix(env, EnvLogtubeAutoMapping+"=") {
+			logPath = strings.TrimPrefix(env, EnvLogtubeAutoMapping+"=")
+			return
+		}
+	}
+	logPath = cfg.Config.Labels[LabelLogtubeAutoMappingPath]
+	return
+}
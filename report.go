@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	ResultUnchanged   = "unchanged"
+	ResultCreated     = "created"
+	ResultUpdated     = "updated"
+	ResultUnmapped    = "unmapped"
+	ResultSkipped     = "skipped"
+	ResultConflicting = "conflicting"
+	ResultInvalid     = "invalid"
+	ResultFailed      = "failed"
+)
+
+// reportResults ordered results in summary
+var reportResults = []string{ResultUnchanged, ResultCreated, ResultUpdated, ResultUnmapped, ResultSkipped, ResultConflicting, ResultInvalid, ResultFailed}
+
+// ReportEntry is the result of a single workload
+type ReportEntry struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Result    string `json:"result"`
+	Message   string `json:"message,omitempty"`
+	// Diff unified diff of pod spec, dry run only
+	Diff string `json:"diff,omitempty"`
+	// PatchType and Patch the patch sent, or would be sent in dry run
+	PatchType string          `json:"patchType,omitempty"`
+	Patch     json.RawMessage `json:"patch,omitempty"`
+}
+
+// Report collects results of workloads in a run, a nil *Report discards everything
+type Report struct {
+	mu      sync.Mutex
+	entries []ReportEntry
+}
+
+func (r *Report) add(wl *Workload, result, message string) {
+	r.addEntry(ReportEntry{Kind: wl.Kind, Namespace: wl.Namespace, Name: wl.Name, Result: result, Message: message})
+}
+
+func (r *Report) addEntry(e ReportEntry) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+}
+
+// addListErrors records failed list calls in the aggregate returned by walkWorkloads as failed entries,
+// other errors are returned as they are
+func (r *Report) addListErrors(err error) error {
+	agg, ok := err.(utilerrors.Aggregate)
+	if !ok {
+		return err
+	}
+	for _, e := range agg.Errors() {
+		if le, ok := e.(*ListError); ok {
+			r.addEntry(ReportEntry{Kind: le.Kind, Namespace: le.Namespace, Name: "*", Result: ResultFailed, Message: le.Error()})
+		}
+	}
+	return nil
+}
+
+// count returns number of entries with the result
+func (r *Report) count(result string) (n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		if e.Result == result {
+			n++
+		}
+	}
+	return
+}
+
+// Print logs the summary, and details of workloads not mapped
+func (r *Report) Print() {
+	var counts []string
+	for _, result := range reportResults {
+		counts = append(counts, fmt.Sprintf("%d %s", r.count(result), result))
+	}
+	log.Println("report: " + strings.Join(counts, ", "))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := append([]ReportEntry{}, r.entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Result < entries[j].Result
+	})
+	for _, e := range entries {
+		switch e.Result {
+		case ResultUnchanged, ResultCreated, ResultUpdated, ResultUnmapped:
+			continue
+		}
+		log.Printf("└ %s: %s/%s/%s: %s", e.Result, e.Kind, e.Namespace, e.Name, e.Message)
+	}
+}
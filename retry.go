@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	optMaxFailures, _ = strconv.Atoi(os.Getenv("AUTO_LOGTUBE_MAPPING_MAX_FAILURES"))
+
+	// apiBackoff backoff of retrying API calls, 0.5s, 1s, 2s, 4s
+	apiBackoff = wait.Backoff{
+		Steps:    5,
+		Duration: 500 * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.1,
+	}
+)
+
+// isRetriable checks whether an API error is transient, server errors, throttling and timeouts
+func isRetriable(err error) bool {
+	if apierrors.IsInternalError(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsUnexpectedServerError(err) {
+		return true
+	}
+	if status, ok := err.(apierrors.APIStatus); ok && status.Status().Code >= 500 {
+		return true
+	}
+	return false
+}
+
+// retryAPI calls fn until it succeeds, returns a non-retriable error, or the backoff is exhausted
+func retryAPI(ctx context.Context, retriable func(err error) bool, fn func() error) error {
+	return retry.OnError(apiBackoff, func(err error) bool {
+		return ctx.Err() == nil && retriable(err)
+	}, fn)
+}
+
+// ListError is a failed list call, workloads of the kind in the namespace are not processed
+type ListError struct {
+	Kind      string
+	Namespace string
+	Err       error
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("failed to list %s in namespace %s: %s", e.Kind, e.Namespace, e.Err.Error())
+}
+
+// patchRetrying patches the workload, retries transient errors, conflicts are retried only for strategic merge patch,
+// since JSON patch pins the resource version, and server-side apply conflicts are between field managers
+func (wl *Workload) patchRetrying(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+	scopeLog := buildLogger(wl.Kind, wl.Name)
+	return retryAPI(ctx, func(err error) bool {
+		if isRetriable(err) || (pt == types.StrategicMergePatchType && apierrors.IsConflict(err)) {
+			scopeLog("retrying: " + err.Error())
+			return true
+		}
+		return false
+	}, func() error {
+		return wl.patch(ctx, pt, data, opts)
+	})
+}
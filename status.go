@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"strings"
+)
+
+// describeMapping describes host paths and mount paths of auto mapping in a workload
+func (wl *Workload) describeMapping() string {
+	var items []string
+	for _, v := range wl.Template.Spec.Volumes {
+		if !isAutoMappingVolume(v.Name) || v.HostPath == nil {
+			continue
+		}
+		var mounts []string
+		for _, c := range wl.Template.Spec.Containers {
+			for _, vm := range c.VolumeMounts {
+				if vm.Name != v.Name {
+					continue
+				}
+				if vm.SubPath != "" {
+					mounts = append(mounts, c.Name+":"+vm.MountPath+" ("+vm.SubPath+")")
+				} else {
+					mounts = append(mounts, c.Name+":"+vm.MountPath)
+				}
+			}
+		}
+		items = append(items, v.HostPath.Path+" <- "+strings.Join(mounts, ", "))
+	}
+	return strings.Join(items, "; ")
+}
+
+// runStatus shows current mappings of workloads in scope
+func runStatus(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset) error {
+	return walkWorkloads(ctx, cfg, client, func(wl *Workload) error {
+		mapped, enabled := wl.mapped(), wl.enabled()
+		if !mapped && !enabled {
+			return nil
+		}
+		scopeLog := buildLogger(wl.Kind, wl.Name)
+		switch {
+		case mapped && enabled:
+			scopeLog("mapped: " + wl.describeMapping())
+		case mapped:
+			scopeLog("mapped but not enabled: " + wl.describeMapping())
+		default:
+			scopeLog("enabled but not mapped")
+		}
+		return nil
+	})
+}
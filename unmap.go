@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	optUnmapWorkload    = os.Getenv("AUTO_LOGTUBE_MAPPING_UNMAP_WORKLOAD")
+	optAllNamespaces, _ = strconv.ParseBool(os.Getenv("AUTO_LOGTUBE_MAPPING_ALL_NAMESPACES"))
+)
+
+// buildUnmapPatch builds patch removing auto mapping volumes and related volume mounts from workload
+func (wl *Workload) buildUnmapPatch() (pt types.PatchType, data []byte, err error) {
+	spec := &wl.Template.Spec
+
+	volumeNames := map[string]bool{}
+	for _, v := range spec.Volumes {
+		if isAutoMappingVolume(v.Name) {
+			volumeNames[v.Name] = true
+		}
+	}
+
+	if wl.JSONPatch {
+		prefix := "/" + strings.Join(wl.templatePath(), "/") + "/spec"
+		var ops []JSONPatchOperation
+		if wl.ResourceVersion != "" {
+			ops = append(ops, JSONPatchOperation{Op: "test", Path: "/metadata/resourceVersion", Value: wl.ResourceVersion})
+		}
+		// remove from the tail, or indexes shift
+		for i, c := range spec.Containers {
+			for j := len(c.VolumeMounts) - 1; j >= 0; j-- {
+				if volumeNames[c.VolumeMounts[j].Name] {
+					ops = append(ops, JSONPatchOperation{Op: "remove", Path: prefix + "/containers/" + strconv.Itoa(i) + "/volumeMounts/" + strconv.Itoa(j)})
+				}
+			}
+		}
+		for i := len(spec.Volumes) - 1; i >= 0; i-- {
+			if volumeNames[spec.Volumes[i].Name] {
+				ops = append(ops, JSONPatchOperation{Op: "remove", Path: prefix + "/volumes/" + strconv.Itoa(i)})
+			}
+		}
+		pt = types.JSONPatchType
+		data, err = json.Marshal(ops)
+		return
+	}
+
+	type containerPatch struct {
+		Name         string                   `json:"name"`
+		VolumeMounts []map[string]interface{} `json:"volumeMounts"`
+	}
+
+	var volumes []map[string]interface{}
+	for _, v := range spec.Volumes {
+		if volumeNames[v.Name] {
+			volumes = append(volumes, map[string]interface{}{"$patch": "delete", "name": v.Name})
+		}
+	}
+	var containers []containerPatch
+	for _, c := range spec.Containers {
+		cp := containerPatch{Name: c.Name}
+		for _, vm := range c.VolumeMounts {
+			if volumeNames[vm.Name] {
+				cp.VolumeMounts = append(cp.VolumeMounts, map[string]interface{}{"$patch": "delete", "mountPath": vm.MountPath})
+			}
+		}
+		if len(cp.VolumeMounts) > 0 {
+			containers = append(containers, cp)
+		}
+	}
+
+	podSpec := map[string]interface{}{"volumes": volumes}
+	if len(containers) > 0 {
+		podSpec["containers"] = containers
+	}
+	pt = types.StrategicMergePatchType
+	data, err = json.Marshal(nestAt(wl.templatePath(), map[string]interface{}{"spec": podSpec}))
+	return
+}
+
+// unmapWorkload removes auto mapping from a workload
+func unmapWorkload(ctx context.Context, wl *Workload) (err error) {
+	scopeLog := buildLogger(wl.Kind, wl.Name)
+	if !wl.mapped() {
+		return
+	}
+	if wl.Immutable {
+		scopeLog("pod template is immutable, skipped")
+		return
+	}
+	var pt types.PatchType
+	var patch []byte
+	if pt, patch, err = wl.buildUnmapPatch(); err != nil {
+		return
+	}
+	if !optDryRun {
+		opts := metav1.PatchOptions{}
+		if optValidate {
+			opts.DryRun = []string{metav1.DryRunAll}
+		}
+		if err = wl.patchRetrying(ctx, pt, patch, opts); err != nil {
+			return
+		}
+	}
+	if wl.enabled() {
+		scopeLog("unmapped, annotation " + AnnotationLogtubeAutoMappingEnabled + " is still set, it will be mapped again")
+	} else {
+		scopeLog("unmapped")
+	}
+	return
+}
+
+// runUnmap removes auto mapping from a single workload given by --workload, or all workloads in the namespace,
+// all namespaces only with --all-namespaces
+func runUnmap(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset) (err error) {
+	if optNamespace == "" && !optAllNamespaces {
+		err = errors.New("missing --namespace, or --all-namespaces to unmap workloads in all namespaces")
+		return
+	}
+	if optUnmapWorkload == "" {
+		err = unmapWorkloads(ctx, cfg, client)
+		return
+	}
+	if optNamespace == "" {
+		err = errors.New("--workload requires --namespace")
+		return
+	}
+	splits := strings.Split(optUnmapWorkload, "/")
+	if len(splits) != 2 || splits[0] == "" || splits[1] == "" {
+		err = fmt.Errorf("invalid workload '%s', expect KIND/NAME", optUnmapWorkload)
+		return
+	}
+	var wl *Workload
+	if wl, err = getWorkload(ctx, cfg, client, strings.ToLower(splits[0]), optNamespace, splits[1]); err != nil {
+		return
+	}
+	if !wl.mapped() {
+		buildLogger(wl.Kind, wl.Name)("not mapped")
+		return
+	}
+	err = unmapWorkload(ctx, wl)
+	return
+}
+
+// unmapWorkloads walks through workloads in scope, a failed workload is recorded in report and never stops the others
+func unmapWorkloads(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset) (err error) {
+	report := &Report{}
+	err = walkWorkloads(ctx, cfg, client, func(wl *Workload) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		report.addEntry(unmapReportEntry(ctx, wl))
+		return nil
+	})
+	// failed list calls are counted as failures as well
+	err = report.addListErrors(err)
+	report.Print()
+	if n := report.count(ResultFailed); n > 0 && err == nil {
+		err = fmt.Errorf("failed to unmap %d workloads", n)
+	}
+	return
+}
+
+// unmapReportEntry unmaps a workload, and returns the result for report
+func unmapReportEntry(ctx context.Context, wl *Workload) ReportEntry {
+	e := ReportEntry{Kind: wl.Kind, Namespace: wl.Namespace, Name: wl.Name}
+	switch {
+	case !wl.mapped():
+		e.Result, e.Message = ResultUnchanged, "not mapped"
+	case wl.Immutable:
+		e.Result, e.Message = ResultSkipped, "pod template is immutable"
+	default:
+		if err := unmapWorkload(ctx, wl); err != nil {
+			buildLogger(wl.Kind, wl.Name)("failed to unmap: " + err.Error())
+			e.Result, e.Message = ResultFailed, err.Error()
+		} else {
+			e.Result = ResultUnmapped
+		}
+	}
+	return e
+}
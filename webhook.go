@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	optWebhookAddr    = os.Getenv("AUTO_LOGTUBE_MAPPING_WEBHOOK_ADDR")
+	optWebhookTLSCert = os.Getenv("AUTO_LOGTUBE_MAPPING_WEBHOOK_TLS_CERT")
+	optWebhookTLSKey  = os.Getenv("AUTO_LOGTUBE_MAPPING_WEBHOOK_TLS_KEY")
+)
+
+// cronJobName returns name of the cronjob creating a job, or empty string, jobs created by cronjob are named as
+// [CRONJOB]-[SCHEDULED TIME IN MINUTES], unique per run
+func cronJobName(jobName string) string {
+	i := strings.LastIndex(jobName, "-")
+	if i <= 0 || len(jobName)-i-1 < 8 {
+		return ""
+	}
+	for _, r := range jobName[i+1:] {
+		if r < '0' || r > '9' {
+			return ""
+		}
+	}
+	return jobName[:i]
+}
+
+// podWorkloadName returns the name used for host path of a pod, workload name is preferred
+func podWorkloadName(pod *corev1.Pod) string {
+	if _, name := podOwner(pod); name != "" {
+		return name
+	}
+	if ref := metav1.GetControllerOf(pod); ref != nil {
+		return ref.Name
+	}
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return strings.TrimSuffix(pod.GenerateName, "-")
+}
+
+// mutate builds JSON patch for the object in an admission request, returns nil if nothing to patch
+func mutate(ctx context.Context, req *admissionv1.AdmissionRequest) (ops []JSONPatchOperation, err error) {
+	var (
+		annotations map[string]string
+		name        string
+		prefix      string
+		spec        *corev1.PodSpec
+	)
+
+	switch req.Kind.Kind {
+	case "Pod":
+		var pod corev1.Pod
+		if err = json.Unmarshal(req.Object.Raw, &pod); err != nil {
+			return
+		}
+		annotations, name, prefix, spec = pod.Annotations, podWorkloadName(&pod), "/spec", &pod.Spec
+	case "Deployment":
+		var dp appsv1.Deployment
+		if err = json.Unmarshal(req.Object.Raw, &dp); err != nil {
+			return
+		}
+		annotations, name, prefix, spec = dp.Annotations, dp.Name, "/spec/template/spec", &dp.Spec.Template.Spec
+	case "StatefulSet":
+		var st appsv1.StatefulSet
+		if err = json.Unmarshal(req.Object.Raw, &st); err != nil {
+			return
+		}
+		annotations, name, prefix, spec = st.Annotations, st.Name, "/spec/template/spec", &st.Spec.Template.Spec
+	case "DaemonSet":
+		var ds appsv1.DaemonSet
+		if err = json.Unmarshal(req.Object.Raw, &ds); err != nil {
+			return
+		}
+		annotations, name, prefix, spec = ds.Annotations, ds.Name, "/spec/template/spec", &ds.Spec.Template.Spec
+	case "CronJob":
+		var cj batchv1beta1.CronJob
+		if err = json.Unmarshal(req.Object.Raw, &cj); err != nil {
+			return
+		}
+		annotations, name, prefix, spec = cj.Annotations, cj.Name, "/spec/jobTemplate/spec/template/spec", &cj.Spec.JobTemplate.Spec.Template.Spec
+	case "Job":
+		var job batchv1.Job
+		if err = json.Unmarshal(req.Object.Raw, &job); err != nil {
+			return
+		}
+		// jobs created by cronjob are already mutated through the cronjob
+		if metav1.GetControllerOf(&job) != nil {
+			return
+		}
+		annotations, name, prefix, spec = job.Annotations, job.Name, "/spec/template/spec", &job.Spec.Template.Spec
+	default:
+		err = errors.New("unsupported kind: " + req.Kind.Kind)
+		return
+	}
+
+	if !isEnabled(annotations) {
+		return
+	}
+
+	// no pod to exec into, only discoverers working on spec take effect
+	var chain []Discoverer
+	if chain, err = newDiscoveryChain(nil, nil); err != nil {
+		return
+	}
+	var results []DiscoveryResult
+	if results, err = (&Discovery{
+		Chain:       chain,
+		Namespace:   req.Namespace,
+		Annotations: annotations,
+		Spec:        spec,
+	}).Run(ctx); err != nil {
+		return
+	}
+
+	wp := newWorkloadPatch(req.Namespace, name)
+	wp.applyDiscoveryResults(results)
+
+	ops = wp.jsonPatch(prefix, spec)
+	return
+}
+
+func handleMutate(rw http.ResponseWriter, r *http.Request) {
+	var err error
+	var review admissionv1.AdmissionReview
+
+	var body []byte
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = json.Unmarshal(body, &review); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(rw, "missing admission request", http.StatusBadRequest)
+		return
+	}
+
+	req := review.Request
+	res := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+
+	scopeLog := buildLogger(strings.ToLower(req.Kind.Kind), req.Namespace+"/"+req.Name)
+
+	// never deny the request, failures are logged only
+	var ops []JSONPatchOperation
+	if ops, err = mutate(r.Context(), req); err != nil {
+		scopeLog("failed to mutate: " + err.Error())
+	} else if len(ops) > 0 {
+		var patch []byte
+		if patch, err = json.Marshal(ops); err != nil {
+			scopeLog("failed to marshal patch: " + err.Error())
+		} else {
+			patchType := admissionv1.PatchTypeJSONPatch
+			res.Patch = patch
+			res.PatchType = &patchType
+			scopeLog("patched")
+		}
+	}
+
+	review.Request = nil
+	review.Response = res
+
+	var buf []byte
+	if buf, err = json.Marshal(review); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(buf)
+}
+
+// runWebhook runs the mutating admission webhook mode
+func runWebhook(ctx context.Context) (err error) {
+	addr := optWebhookAddr
+	if addr == "" {
+		addr = ":8443"
+	}
+	if optWebhookTLSCert == "" || optWebhookTLSKey == "" {
+		err = errors.New("missing environment variable: AUTO_LOGTUBE_MAPPING_WEBHOOK_TLS_CERT or AUTO_LOGTUBE_MAPPING_WEBHOOK_TLS_KEY")
+		return
+	}
+
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/mutate", handleMutate)
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("OK"))
+	})
+
+	s := &http.Server{Addr: addr, Handler: mux}
+
+	chErr := make(chan error, 1)
+	go func() {
+		log.Printf("webhook listening at %s", addr)
+		chErr <- s.ListenAndServeTLS(optWebhookTLSCert, optWebhookTLSKey)
+	}()
+
+	select {
+	case err = <-chErr:
+		return
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = s.Shutdown(shutdownCtx); err != nil {
+		err = fmt.Errorf("failed to shutdown webhook: %s", err.Error())
+	}
+	return
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	KindDeployment  = "deployment"
+	KindStatefulSet = "statefulset"
+	KindDaemonSet   = "daemonset"
+	KindCronJob     = "cronjob"
+	KindJob         = "job"
+)
+
+// Workload is a kind-independent view of a workload owning a pod template
+type Workload struct {
+	Kind        string
+	Namespace   string
+	Name        string
+	UID         types.UID
+	Annotations map[string]string
+	Replicas    int32
+	Selector    *metav1.LabelSelector
+	Template    *corev1.PodTemplateSpec
+
+	// TemplatePath path of the pod template in workload, spec.template if empty
+	TemplatePath []string
+	// SpecOnly log path can only be discovered from spec, since pods are short-lived
+	SpecOnly bool
+	// Immutable pod template can not be patched after creation
+	Immutable bool
+	// JSONPatch patch with RFC 6902 JSON patch, since strategic merge patch does not work on custom resources
+	JSONPatch bool
+	// ResourceVersion resource version tested in JSON patch
+	ResourceVersion string
+	// APIVersion and ObjectKind type of the workload object, required by server-side apply
+	APIVersion string
+	ObjectKind string
+	// ApplyManagers field managers ever server-side applied to the workload
+	ApplyManagers []string
+
+	patch func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) error
+	// revision returns the label identifying pods of the current pod template, empty if unknown
+	revision func(ctx context.Context) (key, value string, err error)
+}
+
+func isEnabled(annotations map[string]string) bool {
+	enabled, _ := strconv.ParseBool(annotations[AnnotationLogtubeAutoMappingEnabled])
+	return enabled
+}
+
+func (wl *Workload) enabled() bool {
+	return isEnabled(wl.Annotations)
+}
+
+// isAutoMappingVolume checks volume name, either the legacy single volume or a per container one
+func isAutoMappingVolume(name string) bool {
+	return name == VolumeNameLogtubeAutoMapping || strings.HasPrefix(name, VolumeNameLogtubeAutoMapping+"-")
+}
+
+// mapped returns true if the pod template already carries the auto mapping volume
+func (wl *Workload) mapped() bool {
+	for _, v := range wl.Template.Spec.Volumes {
+		if isAutoMappingVolume(v.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// templatePath returns path of the pod template, spec.template if not specified
+func (wl *Workload) templatePath() []string {
+	if len(wl.TemplatePath) == 0 {
+		return []string{"spec", "template"}
+	}
+	return wl.TemplatePath
+}
+
+// buildPatch renders the workload patch in the patch type supported by the workload,
+// existing mappings are always updated with JSON patch, since strategic merge patch can not drop a stale subPath
+func (wl *Workload) buildPatch(wp *WorkloadPatch) (pt types.PatchType, data []byte, err error) {
+	if !wl.JSONPatch && wp.compare(&wl.Template.Spec) != ResultUpdated {
+		pt = types.StrategicMergePatchType
+		data, err = wp.jsonMarshalAt(wl.TemplatePath)
+		return
+	}
+	var ops []JSONPatchOperation
+	// pod template is modified since listed, indexes in operations are no longer valid
+	if wl.ResourceVersion != "" {
+		ops = append(ops, JSONPatchOperation{Op: "test", Path: "/metadata/resourceVersion", Value: wl.ResourceVersion})
+	}
+	ops = append(ops, wp.jsonPatch("/"+strings.Join(wl.templatePath(), "/")+"/spec", &wl.Template.Spec)...)
+	pt = types.JSONPatchType
+	data, err = json.Marshal(ops)
+	return
+}
+
+func newDeploymentWorkload(client *kubernetes.Clientset, dp *appsv1.Deployment) *Workload {
+	return &Workload{
+		Kind:            KindDeployment,
+		Namespace:       dp.Namespace,
+		Name:            dp.Name,
+		UID:             dp.UID,
+		ResourceVersion: dp.ResourceVersion,
+		APIVersion:      appsv1.SchemeGroupVersion.String(),
+		ObjectKind:      "Deployment",
+		ApplyManagers:   applyManagers(dp.ManagedFields),
+		Annotations:     dp.Annotations,
+		Replicas:        dp.Status.Replicas,
+		Selector:        dp.Spec.Selector,
+		Template:        &dp.Spec.Template,
+		patch: func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) (err error) {
+			_, err = client.AppsV1().Deployments(dp.Namespace).Patch(ctx, dp.Name, pt, data, opts)
+			return
+		},
+		revision: func(ctx context.Context) (string, string, error) {
+			return deploymentRevision(ctx, client, dp)
+		},
+	}
+}
+
+func newStatefulSetWorkload(client *kubernetes.Clientset, st *appsv1.StatefulSet) *Workload {
+	return &Workload{
+		Kind:            KindStatefulSet,
+		Namespace:       st.Namespace,
+		Name:            st.Name,
+		UID:             st.UID,
+		ResourceVersion: st.ResourceVersion,
+		APIVersion:      appsv1.SchemeGroupVersion.String(),
+		ObjectKind:      "StatefulSet",
+		ApplyManagers:   applyManagers(st.ManagedFields),
+		Annotations:     st.Annotations,
+		Replicas:        st.Status.Replicas,
+		Selector:        st.Spec.Selector,
+		Template:        &st.Spec.Template,
+		patch: func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) (err error) {
+			_, err = client.AppsV1().StatefulSets(st.Namespace).Patch(ctx, st.Name, pt, data, opts)
+			return
+		},
+		revision: func(ctx context.Context) (key, value string, err error) {
+			if st.Status.UpdateRevision != "" {
+				key, value = appsv1.ControllerRevisionHashLabelKey, st.Status.UpdateRevision
+			}
+			return
+		},
+	}
+}
+
+func newDaemonSetWorkload(client *kubernetes.Clientset, ds *appsv1.DaemonSet) *Workload {
+	return &Workload{
+		Kind:            KindDaemonSet,
+		Namespace:       ds.Namespace,
+		Name:            ds.Name,
+		UID:             ds.UID,
+		ResourceVersion: ds.ResourceVersion,
+		APIVersion:      appsv1.SchemeGroupVersion.String(),
+		ObjectKind:      "DaemonSet",
+		ApplyManagers:   applyManagers(ds.ManagedFields),
+		Annotations:     ds.Annotations,
+		Replicas:        ds.Status.DesiredNumberScheduled,
+		Selector:        ds.Spec.Selector,
+		Template:        &ds.Spec.Template,
+		patch: func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) (err error) {
+			_, err = client.AppsV1().DaemonSets(ds.Namespace).Patch(ctx, ds.Name, pt, data, opts)
+			return
+		},
+		revision: func(ctx context.Context) (string, string, error) {
+			return daemonSetRevision(ctx, client, ds)
+		},
+	}
+}
+
+func newCronJobWorkload(client *kubernetes.Clientset, cj *batchv1beta1.CronJob) *Workload {
+	return &Workload{
+		Kind:            KindCronJob,
+		Namespace:       cj.Namespace,
+		Name:            cj.Name,
+		UID:             cj.UID,
+		ResourceVersion: cj.ResourceVersion,
+		APIVersion:      batchv1beta1.SchemeGroupVersion.String(),
+		ObjectKind:      "CronJob",
+		ApplyManagers:   applyManagers(cj.ManagedFields),
+		Annotations:     cj.Annotations,
+		Selector:        cj.Spec.JobTemplate.Spec.Selector,
+		Template:        &cj.Spec.JobTemplate.Spec.Template,
+		TemplatePath:    []string{"spec", "jobTemplate", "spec", "template"},
+		SpecOnly:        true,
+		patch: func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) (err error) {
+			_, err = client.BatchV1beta1().CronJobs(cj.Namespace).Patch(ctx, cj.Name, pt, data, opts)
+			return
+		},
+	}
+}
+
+func newJobWorkload(client *kubernetes.Clientset, job *batchv1.Job) *Workload {
+	return &Workload{
+		Kind:            KindJob,
+		Namespace:       job.Namespace,
+		Name:            job.Name,
+		UID:             job.UID,
+		ResourceVersion: job.ResourceVersion,
+		APIVersion:      batchv1.SchemeGroupVersion.String(),
+		ObjectKind:      "Job",
+		ApplyManagers:   applyManagers(job.ManagedFields),
+		Annotations:     job.Annotations,
+		Replicas:        job.Status.Active,
+		Selector:        job.Spec.Selector,
+		Template:        &job.Spec.Template,
+		SpecOnly:        true,
+		Immutable:       true,
+		patch: func(ctx context.Context, pt types.PatchType, data []byte, opts metav1.PatchOptions) (err error) {
+			_, err = client.BatchV1().Jobs(job.Namespace).Patch(ctx, job.Name, pt, data, opts)
+			return
+		},
+	}
+}
+
+// listWorkloads lists all supported workloads in a namespace, list calls are retried on transient errors,
+// failed kinds are returned as an aggregate of *ListError, workloads of other kinds are still returned
+func listWorkloads(ctx context.Context, client *kubernetes.Clientset, namespace string) (wls []*Workload, err error) {
+	var errs []error
+	list := func(kind string, fn func() error) {
+		if lErr := retryAPI(ctx, isRetriable, fn); lErr != nil {
+			errs = append(errs, &ListError{Kind: kind, Namespace: namespace, Err: lErr})
+		}
+	}
+
+	list(KindDeployment, func() error {
+		dpList, lErr := client.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+		if lErr == nil {
+			for i := range dpList.Items {
+				wls = append(wls, newDeploymentWorkload(client, &dpList.Items[i]))
+			}
+		}
+		return lErr
+	})
+
+	list(KindStatefulSet, func() error {
+		stList, lErr := client.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+		if lErr == nil {
+			for i := range stList.Items {
+				wls = append(wls, newStatefulSetWorkload(client, &stList.Items[i]))
+			}
+		}
+		return lErr
+	})
+
+	list(KindDaemonSet, func() error {
+		dsList, lErr := client.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+		if lErr == nil {
+			for i := range dsList.Items {
+				wls = append(wls, newDaemonSetWorkload(client, &dsList.Items[i]))
+			}
+		}
+		return lErr
+	})
+
+	list(KindCronJob, func() error {
+		cjList, lErr := client.BatchV1beta1().CronJobs(namespace).List(ctx, metav1.ListOptions{})
+		if lErr == nil {
+			for i := range cjList.Items {
+				wls = append(wls, newCronJobWorkload(client, &cjList.Items[i]))
+			}
+		}
+		return lErr
+	})
+
+	list(KindJob, func() error {
+		jobList, lErr := client.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+		if lErr == nil {
+			for i := range jobList.Items {
+				// jobs created by cronjob are covered by the cronjob
+				if metav1.GetControllerOf(&jobList.Items[i]) != nil {
+					continue
+				}
+				wls = append(wls, newJobWorkload(client, &jobList.Items[i]))
+			}
+		}
+		return lErr
+	})
+
+	err = utilerrors.NewAggregate(errs)
+	return
+}
+
+// getWorkload gets a single workload, kind is one of the built-in kinds, or [RESOURCE].[GROUP] of a custom resource
+func getWorkload(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset, kind, namespace, name string) (wl *Workload, err error) {
+	switch kind {
+	case KindDeployment:
+		var dp *appsv1.Deployment
+		if dp, err = client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return
+		}
+		wl = newDeploymentWorkload(client, dp)
+	case KindStatefulSet:
+		var st *appsv1.StatefulSet
+		if st, err = client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return
+		}
+		wl = newStatefulSetWorkload(client, st)
+	case KindDaemonSet:
+		var ds *appsv1.DaemonSet
+		if ds, err = client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return
+		}
+		wl = newDaemonSetWorkload(client, ds)
+	case KindCronJob:
+		var cj *batchv1beta1.CronJob
+		if cj, err = client.BatchV1beta1().CronJobs(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return
+		}
+		wl = newCronJobWorkload(client, cj)
+	case KindJob:
+		var job *batchv1.Job
+		if job, err = client.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return
+		}
+		wl = newJobWorkload(client, job)
+	default:
+		var crs []CustomResource
+		if crs, err = parseCustomResources(optCustomResources); err != nil {
+			return
+		}
+		for _, cr := range crs {
+			if cr.Kind() != kind {
+				continue
+			}
+			var dynClient dynamic.Interface
+			if dynClient, err = dynamic.NewForConfig(cfg); err != nil {
+				return
+			}
+			var obj *unstructured.Unstructured
+			if obj, err = dynClient.Resource(cr.GVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+				return
+			}
+			wl, err = newCustomWorkload(dynClient, cr, obj)
+			return
+		}
+		err = errors.New("unsupported workload kind: " + kind)
+	}
+	return
+}
+
+// walkWorkloads walks through workloads of all supported kinds, in all namespaces or the selected one,
+// returns an aggregate of *ListError if some list calls failed
+func walkWorkloads(ctx context.Context, cfg *rest.Config, client *kubernetes.Clientset, fn func(wl *Workload) error) (err error) {
+	var crs []CustomResource
+	if crs, err = parseCustomResources(optCustomResources); err != nil {
+		return
+	}
+	var dynClient dynamic.Interface
+	if dynClient, err = dynamic.NewForConfig(cfg); err != nil {
+		return
+	}
+
+	var namespaces []string
+	if optNamespace != "" {
+		namespaces = []string{optNamespace}
+	} else {
+		var nsList *corev1.NamespaceList
+		if err = retryAPI(ctx, isRetriable, func() (err error) {
+			nsList, err = client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+			return
+		}); err != nil {
+			return
+		}
+		for _, ns := range nsList.Items {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+
+	// failed list calls are collected, the remaining namespaces and kinds are still walked through
+	var errs []error
+	for _, ns := range namespaces {
+		log.Printf("namespace: [%s]", ns)
+
+		wls, lErr := listWorkloads(ctx, client, ns)
+		if lErr != nil {
+			log.Println(lErr.Error())
+			errs = append(errs, lErr)
+		}
+
+		var cwls []*Workload
+		if cwls, lErr = listCustomWorkloads(ctx, dynClient, crs, ns); lErr != nil {
+			log.Println(lErr.Error())
+			errs = append(errs, lErr)
+		}
+		wls = append(wls, cwls...)
+
+		for _, wl := range wls {
+			if err = fn(wl); err != nil {
+				return
+			}
+		}
+	}
+	err = utilerrors.Flatten(utilerrors.NewAggregate(errs))
+	return
+}